@@ -0,0 +1,81 @@
+package longpoll
+
+import (
+	"errors"
+	"net/http"
+)
+
+// AckResponse is the response returned after an acknowledgment. It contains
+// the IDs of the delivered events that still wait for an acknowledgment.
+type AckResponse struct {
+	SubscriptionID string `json:"subscriptionId"`
+	InFlight       []int  `json:"inFlight"`
+}
+
+// SetAckMode enables or disables the ack mode. In ack mode the delivered
+// events are not forgotten, but they are sent again with the next responses
+// until the client acknowledges them (see Ack and AckHandler). It is off by
+// default: events are forgotten as soon as they are sent.
+func (lp *LongPoll) SetAckMode(ackMode bool) {
+	lp.mutex.Lock()
+	defer lp.mutex.Unlock()
+
+	lp.ackMode = ackMode
+	if ackMode == false {
+		lp.globalClientToInFlight = make(clientToNewEvents)
+	}
+}
+
+// Ack confirms that a client received the passed events, so they are not sent
+// again. Acknowledging an event more times, or an event that was not delivered,
+// has no effect. It returns the IDs of the events still waiting for an
+// acknowledgment.
+func (lp *LongPoll) Ack(subscriptionID string, eventIDs []int) ([]int, error) {
+	lp.mutex.Lock()
+	defer lp.mutex.Unlock()
+
+	if _, clientExists := lp.globalClients[subscriptionID]; clientExists == false {
+		return nil, errors.New("subscription " + subscriptionID + " does not exist")
+	}
+
+	acknowledged := make(map[int]bool)
+	for _, eventID := range eventIDs {
+		acknowledged[eventID] = true
+	}
+	inFlight := removeEventIDs(lp.globalClientToInFlight[subscriptionID], acknowledged)
+	if len(inFlight) == 0 {
+		delete(lp.globalClientToInFlight, subscriptionID)
+	} else {
+		lp.globalClientToInFlight[subscriptionID] = inFlight
+	}
+	return inFlight, nil
+}
+
+// AckHandler handles the acknowledgment client request. It expects a
+// subscriptionID and the IDs of the received events, as eventID parameters in
+// the query-string (or in a JSON body like {"eventIDs": [...]}). In case of
+// success it returns an object of type AckResponse.
+func (lp *LongPoll) AckHandler(w http.ResponseWriter, r *http.Request) {
+	getRequestID(w, r)
+	r = withBody(r)
+
+	subscriptionID := lp.getSubscriptionID(r)
+	if subscriptionID == "" {
+		sendError(w, 400, ErrorMissingSubscriptionID, "Missing subscriptionID")
+		return
+	}
+
+	eventIDs, ok := getEventIDs(r)
+	if ok == false {
+		sendError(w, 400, ErrorInvalidEventID, "Missing or invalid eventID")
+		return
+	}
+
+	inFlight, err := lp.Ack(subscriptionID, eventIDs)
+	if err != nil {
+		sendError(w, 401, ErrorUnknownSubscription, "Unauthorized")
+		return
+	}
+
+	lp.sendResponse(w, r, AckResponse{subscriptionID, inFlight})
+}
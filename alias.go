@@ -0,0 +1,47 @@
+package longpoll
+
+import "errors"
+
+// AddFeedAlias registers an alias for more feeds (or patterns): a client that
+// subscribes to the alias is subscribed to all its targets, for example to
+// keep a legacy feed name while the events are published on new feeds. The
+// alias is not a feed, so nothing can be published on it. The targets are
+// validated when a client subscribes.
+func (lp *LongPoll) AddFeedAlias(alias string, targets []string) error {
+	targets = uniqueFeeds(targets)
+	if alias == "" || len(targets) == 0 {
+		return errors.New("missing alias or targets")
+	}
+
+	lp.mutex.Lock()
+	defer lp.mutex.Unlock()
+
+	if _, exists := lp.globalFeedToClients[alias]; exists == true {
+		return errors.New("feed " + alias + " already exists")
+	}
+	if _, exists := lp.feedAliases[alias]; exists == true {
+		return errors.New("alias " + alias + " already exists")
+	}
+	lp.feedAliases[alias] = targets
+	return nil
+}
+
+// resolveAliases replaces the aliases with their targets, removing the
+// duplicates
+func (lp *LongPoll) resolveAliases(feeds []string) []string {
+	lp.mutex.RLock()
+	defer lp.mutex.RUnlock()
+
+	if len(lp.feedAliases) == 0 {
+		return feeds
+	}
+	resolved := make([]string, 0, len(feeds))
+	for _, feed := range feeds {
+		if targets, isAlias := lp.feedAliases[feed]; isAlias == true {
+			resolved = append(resolved, targets...)
+			continue
+		}
+		resolved = append(resolved, feed)
+	}
+	return uniqueFeeds(resolved)
+}
@@ -0,0 +1,25 @@
+package longpoll
+
+import "testing"
+
+func TestFeedAlias(t *testing.T) {
+	lp := New()
+	lp.AddFeeds([]string{"feed1", "feed2", "feed3"})
+	if err := lp.AddFeedAlias("all", []string{"feed1", "feed2"}); err != nil {
+		t.Fatalf("alias rejected: %s", err)
+	}
+	if err := lp.AddFeedAlias("feed3", []string{"feed1"}); err == nil {
+		t.Fatal("alias with the name of a feed accepted")
+	}
+
+	subscriptionID := subscribe(t, lp, "feed=all")
+	if info, _ := lp.GetSubscription(subscriptionID); len(info.Feeds) != 2 {
+		t.Fatalf("expected the 2 feeds of the alias, got %v", info.Feeds)
+	}
+	lp.NewEvent("feed1", "event1")
+	lp.NewEvent("feed2", "event2")
+	lp.NewEvent("feed3", "event3")
+	if response := decodeEvents(t, listen(lp, "subscriptionID="+subscriptionID)); len(response.Events) != 2 {
+		t.Fatalf("expected the events of the 2 feeds, got %+v", response)
+	}
+}
@@ -0,0 +1,78 @@
+package longpoll
+
+import (
+	"errors"
+	"net/http"
+)
+
+// Errors returned by an Authorizer to reject a request. Any error other than
+// ErrForbidden (or an error wrapping it) is treated as ErrUnauthorized.
+var (
+	ErrUnauthorized = errors.New("unauthorized")
+	ErrForbidden    = errors.New("forbidden")
+)
+
+// Authorizer decides which clients can subscribe to which feeds
+type Authorizer interface {
+	// CanSubscribe checks if the request can subscribe to the feeds. It
+	// returns the subscriptionID to use (for example the identity of the
+	// authenticated user), or an empty string to keep the one passed by the
+	// client (or a random one). A request is rejected with 403 if the error
+	// is ErrForbidden, and with 401 for any other error.
+	CanSubscribe(r *http.Request, feeds []string) (subscriptionID string, err error)
+}
+
+// ListenAuthorizer is an Authorizer that checks also the listen requests
+type ListenAuthorizer interface {
+	Authorizer
+	// CanListen checks if the request can listen to the events of the
+	// subscription. Errors are handled as in CanSubscribe.
+	CanListen(r *http.Request, subscriptionID string) error
+}
+
+// SetAuthorizer sets the Authorizer consulted before every subscription
+// (and every listen request, if it is a ListenAuthorizer). A nil Authorizer
+// (the default) allows everything.
+func (lp *LongPoll) SetAuthorizer(authorizer Authorizer) {
+	lp.mutex.Lock()
+	lp.authorizer = authorizer
+	lp.mutex.Unlock()
+}
+
+// authorizeSubscription consults the Authorizer, if any, for a subscription
+func (lp *LongPoll) authorizeSubscription(r *http.Request, feeds []string) (string, error) {
+	lp.mutex.RLock()
+	authorizer := lp.authorizer
+	lp.mutex.RUnlock()
+
+	if authorizer == nil {
+		return "", nil
+	}
+	return authorizer.CanSubscribe(r, feeds)
+}
+
+// authorizeListen consults the Authorizer, if it is a ListenAuthorizer, for a
+// listen request
+func (lp *LongPoll) authorizeListen(r *http.Request, subscriptionID string) error {
+	lp.mutex.RLock()
+	authorizer, ok := lp.authorizer.(ListenAuthorizer)
+	lp.mutex.RUnlock()
+
+	if ok == false {
+		return nil
+	}
+	return authorizer.CanListen(r, subscriptionID)
+}
+
+// authError converts an authorization error in the *Error sent to the client
+func authError(err error) *Error {
+	if errors.Is(err, ErrForbidden) {
+		return &Error{http.StatusForbidden, ErrorForbidden, http.StatusText(http.StatusForbidden)}
+	}
+	return &Error{http.StatusUnauthorized, ErrorUnauthorized, http.StatusText(http.StatusUnauthorized)}
+}
+
+// sendAuthError sends the error response for an authorization error
+func sendAuthError(w http.ResponseWriter, err error) {
+	WriteError(w, authError(err))
+}
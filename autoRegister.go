@@ -0,0 +1,43 @@
+package longpoll
+
+import "net/http"
+
+// AllowAutoRegister enables (or disables) the automatic registration of the
+// unknown subscriptions: a listen request with a subscriptionID that does not
+// exist subscribes it, as SubscribeHandler would do, to the feeds passed in
+// the request (typically injected in the context by a middleware that
+// verifies a signed token issued out-of-band). The Authorizer, if any, is
+// consulted with CanSubscribe, and the subscriptionID it returns (if not
+// empty) is used, and sent back in the X-Subscription-ID header. A request
+// without feeds is still rejected with 401. By default the unknown
+// subscriptions are rejected with 401.
+func (lp *LongPoll) AllowAutoRegister(allow bool) {
+	lp.mutex.Lock()
+	lp.autoRegister = allow
+	lp.mutex.Unlock()
+}
+
+// registerOnListen subscribes the unknown subscription of a listen request,
+// if the automatic registration is enabled (see AllowAutoRegister). It
+// returns the subscriptionID to listen to, or false if the registration
+// failed and the error response was sent.
+func (lp *LongPoll) registerOnListen(w http.ResponseWriter, r *http.Request, subscriptionID string) (string, bool) {
+	lp.mutex.RLock()
+	_, exists := lp.globalClients[subscriptionID]
+	autoRegister := lp.autoRegister
+	subscriptionIDHeader := lp.subscriptionIDHeader
+	lp.mutex.RUnlock()
+
+	if exists == true || autoRegister == false || len(lp.getFeeds(r)) == 0 {
+		return subscriptionID, true
+	}
+	registeredID, feeds, ok := lp.subscribe(w, r)
+	if ok == false {
+		return "", false
+	}
+	lp.logger.Printf("Subscription %s registered on listen for %v\n", registeredID, feeds)
+	if registeredID != subscriptionID {
+		w.Header().Set(subscriptionIDHeader, registeredID)
+	}
+	return registeredID, true
+}
@@ -0,0 +1,37 @@
+package longpoll
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAutoRegister(t *testing.T) {
+	lp := New()
+	lp.SetLogger(nil)
+	lp.AddFeed("feed1")
+	lp.SetTimeout(20 * time.Millisecond)
+
+	if w := listen(lp, "subscriptionID=token1&feed=feed1"); w.Code != 401 {
+		t.Fatalf("disabled: expected 401, got %d", w.Code)
+	}
+
+	lp.AllowAutoRegister(true)
+	if w := listen(lp, "subscriptionID=token1"); w.Code != 401 {
+		t.Fatalf("without feeds: expected 401, got %d", w.Code)
+	}
+	r := httptest.NewRequest("GET", "/listen?subscriptionID=token1", nil)
+	r = r.WithContext(NewContext(r.Context(), ContextStruct{Feeds: []string{"feed1"}}))
+	w := httptest.NewRecorder()
+	lp.ListenHandler(w, r)
+	if w.Code != 408 {
+		t.Fatalf("registered: expected 408, got %d %s", w.Code, w.Body.String())
+	}
+	if info, exists := lp.GetSubscription("token1"); exists == false || len(info.Feeds) != 1 {
+		t.Fatalf("subscription not registered: %+v", info)
+	}
+
+	if w := listen(lp, "subscriptionID=token2&feed=unknown"); w.Code != 409 {
+		t.Fatalf("unknown feed: expected 409, got %d", w.Code)
+	}
+}
@@ -0,0 +1,65 @@
+package longpoll
+
+// Broker shares the events among more LongPoll instances (for example more
+// processes behind a load balancer), so a client receives the events even if
+// they are published on a different instance than the one it is connected
+// to. See the redisbroker package for an implementation based on Redis.
+type Broker interface {
+	// Publish sends an event to the other instances
+	Publish(event Event) error
+	// Subscribe registers the function that receives the events published by
+	// the other instances. The events published by this instance must not be
+	// received back.
+	Subscribe(receive func(event Event)) error
+}
+
+// UseBroker shares the events published on this instance with the other
+// instances using the same broker, and delivers to the local clients the
+// events published elsewhere. The events sent to a single subscription with
+// NewEventForClient are not shared, as the subscription lives on this
+// instance. Without a broker, events are delivered only to the clients of
+// this instance.
+func (lp *LongPoll) UseBroker(broker Broker) error {
+	if err := broker.Subscribe(lp.receiveEvent); err != nil {
+		return err
+	}
+	lp.mutex.Lock()
+	lp.broker = broker
+	lp.mutex.Unlock()
+	return nil
+}
+
+// shareEvents sends the events to the other instances, if a broker is used
+func (lp *LongPoll) shareEvents(feedEvents []FeedEvent) error {
+	for _, feedEvent := range feedEvents {
+		if err := lp.shareEvent(Event{Feed: feedEvent.Feed, Data: feedEvent.Data}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// shareEvent sends an event to the other instances, if a broker is used
+func (lp *LongPoll) shareEvent(event Event) error {
+	lp.mutex.RLock()
+	broker := lp.broker
+	lp.mutex.RUnlock()
+
+	if broker == nil {
+		return nil
+	}
+	return broker.Publish(event)
+}
+
+// receiveEvent delivers to the local clients an event published by another
+// instance
+func (lp *LongPoll) receiveEvent(event Event) {
+	waitingClients, err := lp.queueEvent(Event{Feed: event.Feed, Feeds: event.Feeds, Data: event.Data, RequestID: event.RequestID, ExpiresAt: event.ExpiresAt})
+	if err != nil {
+		lp.logger.Printf("Can not deliver event from broker: %s\n", err)
+		return
+	}
+	for client := range waitingClients {
+		go lp.notifyEvent(client)
+	}
+}
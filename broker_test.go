@@ -0,0 +1,57 @@
+package longpoll
+
+import (
+	"sync"
+	"testing"
+)
+
+// recordingBroker is a Broker that records the published events, and lets the
+// tests deliver the events published by another instance
+type recordingBroker struct {
+	mutex     sync.Mutex
+	published []Event
+	receive   func(event Event)
+}
+
+func (b *recordingBroker) Publish(event Event) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.published = append(b.published, event)
+	return nil
+}
+
+func (b *recordingBroker) Subscribe(receive func(event Event)) error {
+	b.receive = receive
+	return nil
+}
+
+func (b *recordingBroker) events() []Event {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return append([]Event(nil), b.published...)
+}
+
+func TestBroker(t *testing.T) {
+	lp := New()
+	lp.AddFeed("feed1")
+	broker := &recordingBroker{}
+	if err := lp.UseBroker(broker); err != nil {
+		t.Fatal(err)
+	}
+	subscriptionID := subscribe(t, lp, "feed=feed1")
+
+	// The local events are shared
+	lp.NewEvent("feed1", "local")
+	if events := broker.events(); len(events) != 1 || events[0].Feed != "feed1" || events[0].Data != "local" {
+		t.Fatalf("expected the local event published, got %+v", events)
+	}
+
+	// The events of the other instances are delivered, but not shared back
+	broker.receive(Event{Feed: "feed1", Data: "remote"})
+	if events := decodeEvents(t, listen(lp, "subscriptionID="+subscriptionID)).Events; len(events) != 2 || events[1].Data != "remote" {
+		t.Fatalf("expected the remote event delivered, got %+v", events)
+	}
+	if events := broker.events(); len(events) != 1 {
+		t.Fatalf("expected the remote event not published again, got %+v", events)
+	}
+}
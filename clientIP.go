@@ -0,0 +1,96 @@
+package longpoll
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// SetTrustedProxies sets the proxies (IP addresses or CIDR ranges, like
+// "10.0.0.0/8") whose X-Forwarded-For and X-Real-IP headers are trusted by
+// ClientIP. By default no proxy is trusted, and the headers are ignored. It
+// returns an error, and keeps the previous proxies, if an entry is not valid.
+func (lp *LongPoll) SetTrustedProxies(proxies []string) error {
+	trustedProxies := make([]*net.IPNet, 0, len(proxies))
+	for _, proxy := range proxies {
+		proxy = strings.TrimSpace(proxy)
+		if strings.Contains(proxy, "/") == false {
+			ip := net.ParseIP(proxy)
+			if ip == nil {
+				return errors.New("invalid proxy " + proxy)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			trustedProxies = append(trustedProxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return errors.New("invalid proxy " + proxy)
+		}
+		trustedProxies = append(trustedProxies, network)
+	}
+
+	lp.mutex.Lock()
+	lp.trustedProxies = trustedProxies
+	lp.mutex.Unlock()
+	return nil
+}
+
+// ClientIP returns the IP address of the client of a request. If the request
+// comes from a trusted proxy (see SetTrustedProxies), the address is taken
+// from X-Forwarded-For (the last address not belonging to a trusted proxy)
+// or from X-Real-IP. An Authorizer can use it to check the origin of the
+// requests. It is safe to call it concurrently with the handlers.
+func (lp *LongPoll) ClientIP(r *http.Request) string {
+	lp.mutex.RLock()
+	defer lp.mutex.RUnlock()
+
+	return lp.clientIP(r)
+}
+
+// clientIP is ClientIP. It must be called holding the lock.
+func (lp *LongPoll) clientIP(r *http.Request) string {
+	remoteIP, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		remoteIP = r.RemoteAddr
+	}
+	if lp.isTrustedProxy(remoteIP) == false {
+		return remoteIP
+	}
+
+	if forwardedFor := r.Header.Values("X-Forwarded-For"); len(forwardedFor) > 0 {
+		addresses := strings.Split(strings.Join(forwardedFor, ","), ",")
+		for i := len(addresses) - 1; i >= 0; i-- {
+			address := strings.TrimSpace(addresses[i])
+			if net.ParseIP(address) == nil {
+				break
+			}
+			if lp.isTrustedProxy(address) == false || i == 0 {
+				return address
+			}
+		}
+	}
+	if realIP := strings.TrimSpace(r.Header.Get("X-Real-IP")); net.ParseIP(realIP) != nil {
+		return realIP
+	}
+	return remoteIP
+}
+
+// isTrustedProxy checks if an address belongs to a trusted proxy. It must be
+// called holding the lock.
+func (lp *LongPoll) isTrustedProxy(address string) bool {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return false
+	}
+	for _, network := range lp.trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
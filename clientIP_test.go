@@ -0,0 +1,41 @@
+package longpoll
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	lp := New()
+	r := httptest.NewRequest("GET", "/listen", nil)
+	r.RemoteAddr = "10.0.0.5:1234"
+	r.Header.Set("X-Forwarded-For", "1.2.3.4, 10.0.0.7")
+	if ip := lp.ClientIP(r); ip != "10.0.0.5" {
+		t.Fatalf("without trusted proxies: expected the remote address, got %s", ip)
+	}
+
+	if err := lp.SetTrustedProxies([]string{"10.0.0.0/8"}); err != nil {
+		t.Fatalf("trusted proxies rejected: %s", err)
+	}
+	if ip := lp.ClientIP(r); ip != "1.2.3.4" {
+		t.Fatalf("trusted proxy: expected the forwarded address, got %s", ip)
+	}
+	// The addresses added by the client itself are not trusted
+	r.Header.Set("X-Forwarded-For", "6.6.6.6, 1.2.3.4")
+	if ip := lp.ClientIP(r); ip != "1.2.3.4" {
+		t.Fatalf("spoofed header: expected the last untrusted address, got %s", ip)
+	}
+	r.Header.Del("X-Forwarded-For")
+	r.Header.Set("X-Real-IP", "5.6.7.8")
+	if ip := lp.ClientIP(r); ip != "5.6.7.8" {
+		t.Fatalf("expected the X-Real-IP address, got %s", ip)
+	}
+
+	lp.SetTrustedProxies([]string{"10.0.0.6", "::1"})
+	if ip := lp.ClientIP(r); ip != "10.0.0.5" {
+		t.Fatalf("untrusted proxy: expected the remote address, got %s", ip)
+	}
+	if err := lp.SetTrustedProxies([]string{"not-an-address"}); err == nil {
+		t.Fatal("invalid proxy accepted")
+	}
+}
@@ -0,0 +1,38 @@
+package longpoll
+
+import "time"
+
+// Clock is the source of the time used by LongPoll: the timestamps and the
+// expiration of the events, the listen and notify timeouts, the heartbeats,
+// the durations of the listen requests (in the access log and in the
+// metrics), the TTLs and the cleanup. A fake Clock lets the tests trigger the
+// timeouts and the expirations without waiting.
+type Clock interface {
+	// Now returns the current time
+	Now() time.Time
+	// After waits for the duration to elapse, and then sends the current
+	// time on the returned channel
+	After(d time.Duration) <-chan time.Time
+}
+
+// realClock is the Clock based on the time package
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// SetClock replaces the Clock (by default the real one). A nil Clock restores
+// the real one. It should be called before serving requests.
+func (lp *LongPoll) SetClock(clock Clock) {
+	if clock == nil {
+		clock = realClock{}
+	}
+	lp.mutex.Lock()
+	lp.clock = clock
+	lp.mutex.Unlock()
+}
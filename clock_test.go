@@ -0,0 +1,119 @@
+package longpoll
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestClock(t *testing.T) {
+	lp := New()
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	lp.SetClock(clock)
+	logger := &logRecorder{}
+	lp.SetLogger(logger)
+	lp.AddFeed("feed1")
+	lp.SetTimeout(time.Hour)
+	subscriptionID := subscribe(t, lp, "feed=feed1")
+
+	// The timeout and the duration of the request follow the fake clock
+	done := make(chan int)
+	go func() { done <- listen(lp, "subscriptionID="+subscriptionID).Code }()
+	waitListening(t, lp, subscriptionID)
+	clock.advance(2 * time.Second)
+	// The request could be still starting its timer
+	for fired := false; fired == false; {
+		clock.fire()
+		select {
+		case code := <-done:
+			if code != 408 {
+				t.Fatalf("expected 408, got %d", code)
+			}
+			fired = true
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	if lines := logger.find("listen "); len(lines) != 1 || strings.Contains(lines[0], "wait=2s") == false {
+		t.Fatalf("expected a wait of 2s, got %q", lines)
+	}
+	lp.mutex.RLock()
+	sum := lp.listenWaits.sum
+	lp.mutex.RUnlock()
+	if sum != 2 {
+		t.Fatalf("expected 2s in the listen histogram, got %g", sum)
+	}
+
+	lp.NewEvent("feed1", 1)
+	if events := lp.DrainEvents(subscriptionID); len(events) != 1 || events[0].Timestamp != clock.Now().UnixMilli() {
+		t.Fatalf("expected the timestamp of the fake clock, got %+v", events)
+	}
+}
+
+// waitAfter waits until the fake clock has a pending After call
+func waitAfter(t *testing.T, clock *fakeClock) {
+	t.Helper()
+	for i := 0; i < 200; i++ {
+		clock.Lock()
+		pending := len(clock.waiters)
+		clock.Unlock()
+		if pending > 0 {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatal("no timer started on the clock")
+}
+
+func TestClockHeartbeats(t *testing.T) {
+	lp := New()
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	lp.SetClock(clock)
+	lp.SetLogger(nil)
+	lp.AddFeed("feed1")
+	lp.SetHeartbeatInterval(time.Millisecond)
+	subscriptionID := subscribe(t, lp, "feed=feed1")
+
+	// The heartbeats of the listen requests wait for the fake clock
+	done := make(chan string)
+	go func() { done <- listen(lp, "subscriptionID="+subscriptionID).Body.String() }()
+	waitListening(t, lp, subscriptionID)
+	time.Sleep(20 * time.Millisecond)
+	lp.NewEvent("feed1", 1)
+	if body := <-done; strings.HasPrefix(body, " ") == true {
+		t.Fatalf("heartbeat sent without the clock: %q", body)
+	}
+
+	// And so do the heartbeats of the SSE stream
+	server := httptest.NewServer(http.HandlerFunc(lp.SSEHandler))
+	defer server.Close()
+	response, err := http.Get(server.URL + "?subscriptionID=" + subscriptionID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	reader := bufio.NewReader(response.Body)
+
+	waitAfter(t, clock)
+	time.Sleep(20 * time.Millisecond)
+	lp.NewEvent("feed1", 2)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.HasPrefix(line, ": heartbeat") {
+			t.Fatal("heartbeat sent without the clock")
+		}
+		if strings.HasPrefix(line, "id:") {
+			break
+		}
+	}
+	waitAfter(t, clock)
+	clock.fire()
+	if comments := readSSEField(t, reader, "", 1); comments[0] != "heartbeat" {
+		t.Fatalf("expected a heartbeat, got %v", comments)
+	}
+}
@@ -0,0 +1,53 @@
+package longpoll
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"strings"
+)
+
+// minCompressionSize is the size under which a response is not worth to be
+// compressed
+const minCompressionSize = 1024
+
+// SetCompression enables the gzip compression of the listen responses and of
+// the SSE streams, for the clients that send Accept-Encoding: gzip. The
+// responses smaller than 1KB are never compressed.
+func (lp *LongPoll) SetCompression(enabled bool) {
+	lp.mutex.Lock()
+	lp.compression = enabled
+	lp.mutex.Unlock()
+}
+
+// mustCompress checks if the compression is enabled and the client accepts
+// gzip encoded responses
+func (lp *LongPoll) mustCompress(r *http.Request) bool {
+	lp.mutex.RLock()
+	compression := lp.compression
+	lp.mutex.RUnlock()
+	if compression == false {
+		return false
+	}
+
+	for _, accepted := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		encoding := strings.TrimSpace(strings.SplitN(accepted, ";", 2)[0])
+		if encoding == "gzip" {
+			return true
+		}
+	}
+	return false
+}
+
+// gzipContent compresses content with gzip
+func gzipContent(content []byte) ([]byte, error) {
+	var buffer bytes.Buffer
+	writer := gzip.NewWriter(&buffer)
+	if _, err := writer.Write(content); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
@@ -0,0 +1,46 @@
+package longpoll
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCompression(t *testing.T) {
+	lp := New()
+	lp.SetCompression(true)
+	lp.AddFeed("feed1")
+	subscriptionID := subscribe(t, lp, "feed=feed1")
+	payload := strings.Repeat("x", 4*minCompressionSize)
+
+	lp.NewEvent("feed1", payload)
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/listen?subscriptionID="+subscriptionID, nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	lp.ListenHandler(w, r)
+	if w.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatal("large response not compressed")
+	}
+	reader, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var response EventResponse
+	if err := json.NewDecoder(reader).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	if len(response.Events) != 1 || response.Events[0].Data != payload {
+		t.Fatalf("events changed by the compression: %+v", response.Events)
+	}
+
+	lp.NewEvent("feed1", "tiny")
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("GET", "/listen?subscriptionID="+subscriptionID, nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	lp.ListenHandler(w, r)
+	if w.Header().Get("Content-Encoding") != "" || strings.Contains(w.Body.String(), "tiny") == false {
+		t.Fatalf("tiny response compressed: %q", w.Body.String())
+	}
+}
@@ -0,0 +1,63 @@
+package longpoll
+
+import (
+	"errors"
+	"time"
+)
+
+// DefaultDeduplicationTTL is how long the IDs passed to NewEventWithID are
+// remembered
+const DefaultDeduplicationTTL = 10 * time.Minute
+
+// SetDeduplicationTTL sets how long the IDs passed to NewEventWithID are
+// remembered (DefaultDeduplicationTTL by default): an event published again
+// with the same ID after this time is not a duplicate anymore.
+func (lp *LongPoll) SetDeduplicationTTL(ttl time.Duration) error {
+	if ttl <= 0 {
+		return errors.New("deduplication TTL must be greater than zero")
+	}
+	lp.mutex.Lock()
+	lp.deduplicationTTL = ttl
+	lp.mutex.Unlock()
+	return nil
+}
+
+// NewEventWithID publishes an event like NewEvent, but the publisher passes
+// its own ID for the event: an event with an ID already published is ignored,
+// so an at-least-once publisher can publish the same event again without
+// creating duplicates. The IDs are remembered for the time set with
+// SetDeduplicationTTL. The ID is not the ID of the published event.
+func (lp *LongPoll) NewEventWithID(feed string, id string, object interface{}) error {
+	if id == "" {
+		return errors.New("missing event ID")
+	}
+
+	lp.mutex.Lock()
+	if publishedAt, published := lp.publishedIDs[id]; published == true && lp.clock.Now().Sub(publishedAt) < lp.deduplicationTTL {
+		lp.mutex.Unlock()
+		return nil
+	}
+	// The ID is reserved before publishing, so a concurrent publication with
+	// the same ID is ignored
+	lp.publishedIDs[id] = lp.clock.Now()
+	lp.startCleanup()
+	lp.mutex.Unlock()
+
+	if err := lp.NewEvent(feed, object); err != nil {
+		lp.mutex.Lock()
+		delete(lp.publishedIDs, id)
+		lp.mutex.Unlock()
+		return err
+	}
+	return nil
+}
+
+// deletePublishedIDsOlderThan forgets the IDs passed to NewEventWithID before
+// the passed time. It must be called holding the lock.
+func (lp *LongPoll) deletePublishedIDsOlderThan(limit time.Time) {
+	for id, publishedAt := range lp.publishedIDs {
+		if publishedAt.Before(limit) {
+			delete(lp.publishedIDs, id)
+		}
+	}
+}
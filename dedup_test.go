@@ -0,0 +1,39 @@
+package longpoll
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNewEventWithID(t *testing.T) {
+	lp := New()
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	lp.SetClock(clock)
+	lp.AddFeed("feed1")
+	lp.SetDeduplicationTTL(time.Minute)
+	subscriptionID := subscribe(t, lp, "feed=feed1")
+
+	for i := 0; i < 2; i++ {
+		if err := lp.NewEventWithID("feed1", "publish-1", "hello"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if events := lp.DrainEvents(subscriptionID); len(events) != 1 {
+		t.Fatalf("expected a single event, got %+v", events)
+	}
+	if err := lp.NewEventWithID("unknown", "publish-2", 1); err == nil {
+		t.Fatal("published to an unknown feed")
+	}
+	if err := lp.NewEventWithID("feed1", "publish-2", 1); err != nil {
+		t.Fatalf("ID of a failed publish remembered: %s", err)
+	}
+
+	clock.advance(2 * time.Minute)
+	lp.mutex.Lock()
+	lp.deletePublishedIDsOlderThan(clock.Now().Add(-lp.deduplicationTTL))
+	lp.mutex.Unlock()
+	lp.NewEventWithID("feed1", "publish-1", "hello again")
+	if events := lp.DrainEvents(subscriptionID); len(events) != 2 || events[1].Data != "hello again" {
+		t.Fatalf("ID remembered after the TTL: %+v", events)
+	}
+}
@@ -0,0 +1,81 @@
+package longpoll
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+)
+
+// ErrorCode identifies the reason of an error response. The codes are stable,
+// so the clients can rely on them instead of the messages.
+type ErrorCode string
+
+// Error codes sent in the error responses
+const (
+	ErrorMissingFeed           ErrorCode = "MISSING_FEED"
+	ErrorInvalidFeedPattern    ErrorCode = "INVALID_FEED_PATTERN"
+	ErrorFeedNotAvailable      ErrorCode = "FEED_NOT_AVAILABLE"
+	ErrorMissingSubscriptionID ErrorCode = "MISSING_SUBSCRIPTION_ID"
+	ErrorUnknownSubscription   ErrorCode = "UNKNOWN_SUBSCRIPTION"
+	ErrorInvalidEventID        ErrorCode = "INVALID_EVENT_ID"
+	ErrorInvalidBody           ErrorCode = "INVALID_BODY"
+	ErrorPayloadTooLarge       ErrorCode = "PAYLOAD_TOO_LARGE"
+	ErrorMethodNotAllowed      ErrorCode = "METHOD_NOT_ALLOWED"
+	ErrorUnauthorized          ErrorCode = "UNAUTHORIZED"
+	ErrorForbidden             ErrorCode = "FORBIDDEN"
+	ErrorTooManyRequests       ErrorCode = "TOO_MANY_REQUESTS"
+	ErrorTooManyConnections    ErrorCode = "TOO_MANY_CONNECTIONS"
+	ErrorEventsNotAvailable    ErrorCode = "EVENTS_NOT_AVAILABLE"
+	ErrorConnectionAborted     ErrorCode = "CONNECTION_ABORTED"
+	ErrorRequestTimeout        ErrorCode = "REQUEST_TIMEOUT"
+	ErrorSubscriptionRemoved   ErrorCode = "SUBSCRIPTION_REMOVED"
+	ErrorNoFeeds               ErrorCode = "NO_FEEDS"
+	ErrorServiceUnavailable    ErrorCode = "SERVICE_UNAVAILABLE"
+	ErrorStreamingUnsupported  ErrorCode = "STREAMING_NOT_SUPPORTED"
+	ErrorEncodingFailed        ErrorCode = "ENCODING_FAILED"
+	ErrorInternal              ErrorCode = "INTERNAL_ERROR"
+)
+
+// ErrorDetail describes an error
+type ErrorDetail struct {
+	Code    ErrorCode `json:"code"`
+	Message string    `json:"message"`
+}
+
+// ErrorResponse is the body of the error responses, like
+// {"error": {"code": "MISSING_FEED", "message": "Missing feed"}}
+type ErrorResponse struct {
+	Error ErrorDetail `json:"error"`
+}
+
+// Error is an error that can be sent to the client, with its status code and
+// its error code
+type Error struct {
+	Status  int
+	Code    ErrorCode
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// WriteError sends an error response for err. An *Error is sent with its
+// status and code, any other error as an internal error.
+func WriteError(w http.ResponseWriter, err error) {
+	var longpollError *Error
+	if errors.As(err, &longpollError) {
+		sendError(w, longpollError.Status, longpollError.Code, longpollError.Message)
+		return
+	}
+	sendError(w, 500, ErrorInternal, err.Error())
+}
+
+// sendError sends an error response with the status code, and a JSON body
+// with the error code and the message
+func sendError(w http.ResponseWriter, status int, code ErrorCode, message string) {
+	content, _ := json.Marshal(ErrorResponse{ErrorDetail{code, message}})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(content)
+}
@@ -0,0 +1,128 @@
+package longpoll
+
+import (
+	"sort"
+	"sync"
+)
+
+// EventStore persists the published events. The default one is a MemoryStore,
+// but a different backend can be used calling SetEventStore.
+type EventStore interface {
+	// Save stores a new event, and returns it with its ID. IDs must be unique
+	// and always increasing, and they must never be reused, even after the
+	// events are deleted: the client queues reference the events by ID.
+	Save(event Event) (Event, error)
+	// Load returns the event with the passed ID, if it exists
+	Load(eventID int) (Event, bool)
+	// LoadSince returns, sorted by ID, the events of a feed with an ID greater
+	// than eventID. An empty feed means all the feeds. An event published on
+	// more feeds belongs to each of them.
+	LoadSince(feed string, eventID int) []Event
+	// PruneOlderThan deletes the events with a timestamp (milliseconds since
+	// the Unix epoch) lower than the passed one, and returns their IDs
+	PruneOlderThan(timestamp int64) []int
+	// Delete deletes the events with the passed IDs
+	Delete(eventIDs []int)
+}
+
+// EventUpdater is an EventStore that can also replace the stored events. It is
+// used by RemoveFeed to remove the feed from the events published on more
+// feeds, that still belong to the other ones.
+type EventUpdater interface {
+	EventStore
+	// Update replaces the stored event with the same ID, if it exists
+	Update(event Event)
+}
+
+// MemoryStore is an EventStore that keeps the events in memory
+type MemoryStore struct {
+	mutex  sync.RWMutex
+	events events
+	// lastEvent is the ID of the last saved event. It is a counter, and not
+	// the number of stored events, so the IDs of the deleted events are
+	// never assigned again.
+	lastEvent int
+}
+
+// NewMemoryStore is the constructor, it returns a pointer to an empty
+// MemoryStore
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		events: make(events),
+	}
+}
+
+// Save stores a new event, and returns it with its ID
+func (ms *MemoryStore) Save(event Event) (Event, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	ms.lastEvent = ms.lastEvent + 1
+	event.ID = ms.lastEvent
+	ms.events[event.ID] = event
+	return event, nil
+}
+
+// Load returns the event with the passed ID, if it exists
+func (ms *MemoryStore) Load(eventID int) (Event, bool) {
+	ms.mutex.RLock()
+	defer ms.mutex.RUnlock()
+
+	event, exists := ms.events[eventID]
+	return event, exists
+}
+
+// LoadSince returns, sorted by ID, the events of a feed with an ID greater
+// than eventID. An empty feed means all the feeds. The events published on
+// more feeds are returned for each of them.
+func (ms *MemoryStore) LoadSince(feed string, eventID int) []Event {
+	ms.mutex.RLock()
+	defer ms.mutex.RUnlock()
+
+	events := make([]Event, 0)
+	for id, event := range ms.events {
+		if id > eventID && (feed == "" || event.hasFeed(feed)) {
+			events = append(events, event)
+		}
+	}
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].ID < events[j].ID
+	})
+	return events
+}
+
+// PruneOlderThan deletes the events with a timestamp lower than the passed
+// one, and returns their IDs
+func (ms *MemoryStore) PruneOlderThan(timestamp int64) []int {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	pruned := make([]int, 0)
+	for eventID, event := range ms.events {
+		if event.Timestamp < timestamp {
+			pruned = append(pruned, eventID)
+			delete(ms.events, eventID)
+		}
+	}
+	return pruned
+}
+
+// Delete deletes the events with the passed IDs
+func (ms *MemoryStore) Delete(eventIDs []int) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	for _, eventID := range eventIDs {
+		delete(ms.events, eventID)
+	}
+}
+
+// Update replaces the stored event with the same ID, if it exists
+func (ms *MemoryStore) Update(event Event) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	if _, exists := ms.events[event.ID]; exists == true {
+		ms.events[event.ID] = event
+	}
+}
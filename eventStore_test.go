@@ -0,0 +1,21 @@
+package longpoll
+
+import "testing"
+
+func TestMemoryStoreNeverReusesIDs(t *testing.T) {
+	memoryStore := NewMemoryStore()
+	first, _ := memoryStore.Save(Event{Data: 1})
+	second, _ := memoryStore.Save(Event{Data: 2})
+	memoryStore.Delete([]int{first.ID})
+
+	third, _ := memoryStore.Save(Event{Data: 3})
+	if third.ID <= second.ID {
+		t.Fatalf("ID %d assigned after %d", third.ID, second.ID)
+	}
+	if event, exists := memoryStore.Load(second.ID); exists == false || event.Data != 2 {
+		t.Fatalf("event %d overwritten: %+v", second.ID, event)
+	}
+	if _, exists := memoryStore.Load(first.ID); exists == true {
+		t.Fatalf("event %d not deleted", first.ID)
+	}
+}
@@ -0,0 +1,38 @@
+package longpoll
+
+import (
+	"errors"
+	"time"
+)
+
+// NewEventWithTTL sends an event, like NewEvent, that is relevant only for a
+// short time (for example a "typing" indicator): if a client did not receive
+// it within the TTL, the event is dropped from its queue and never
+// delivered. The event is deleted at the expiration, even if a longer TTL is
+// set with SetEventTTL.
+func (lp *LongPoll) NewEventWithTTL(feed string, object interface{}, ttl time.Duration) error {
+	if ttl <= 0 {
+		return errors.New("event TTL must be greater than zero")
+	}
+	return lp.publishEvent(Event{Feed: feed, Data: object, ExpiresAt: lp.clock.Now().Add(ttl).UnixMilli()})
+}
+
+// expired checks if the TTL of an event published with NewEventWithTTL
+// elapsed
+func (event Event) expired(now time.Time) bool {
+	return event.ExpiresAt > 0 && now.UnixMilli() >= event.ExpiresAt
+}
+
+// deleteExpiringEvents deletes the events published with NewEventWithTTL that
+// expired before the passed time, removing them also from the client queues.
+// It must be called holding the lock.
+func (lp *LongPoll) deleteExpiringEvents(now time.Time) {
+	expired := make(map[int]bool)
+	for eventID, expiresAt := range lp.expiringEvents {
+		if now.UnixMilli() >= expiresAt {
+			expired[eventID] = true
+			delete(lp.expiringEvents, eventID)
+		}
+	}
+	lp.deleteEvents(expired)
+}
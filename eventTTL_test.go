@@ -0,0 +1,42 @@
+package longpoll
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNewEventWithTTL(t *testing.T) {
+	lp := New()
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	lp.SetClock(clock)
+	lp.AddFeed("feed1")
+	subscriptionID := subscribe(t, lp, "feed=feed1")
+
+	if err := lp.NewEventWithTTL("feed1", "typing", time.Second); err != nil {
+		t.Fatalf("NewEventWithTTL: %s", err)
+	}
+	lp.NewEvent("feed1", "message")
+	clock.advance(2 * time.Second)
+	if events := lp.DrainEvents(subscriptionID); len(events) != 1 || events[0].Data != "message" {
+		t.Fatalf("expected only the event without TTL, got %+v", events)
+	}
+
+	lp.NewEventWithTTL("feed1", "typing", time.Second)
+	if events := lp.DrainEvents(subscriptionID); len(events) != 1 || events[0].ExpiresAt == 0 {
+		t.Fatalf("expected the event before its expiration, got %+v", events)
+	}
+
+	lp.NewEventWithTTL("feed1", "typing", time.Second)
+	clock.advance(2 * time.Second)
+	lp.mutex.Lock()
+	lp.deleteExpiringEvents(clock.Now())
+	expiring := len(lp.expiringEvents)
+	lp.mutex.Unlock()
+	if info, _ := lp.GetSubscription(subscriptionID); info.QueuedEvents != 0 || expiring != 0 {
+		t.Fatalf("expired event not deleted: %+v, %d expiring events", info, expiring)
+	}
+
+	if err := lp.NewEventWithTTL("feed1", "typing", 0); err == nil {
+		t.Fatal("zero TTL accepted")
+	}
+}
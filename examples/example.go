@@ -14,6 +14,8 @@ func main() {
 	go addEvent(longpoll)
 	http.HandleFunc("/subscribe", longpoll.SubscribeHandler)
 	http.HandleFunc("/listen", longpoll.ListenHandler)
+	http.HandleFunc("/unsubscribe", longpoll.UnsubscribeHandler)
+	http.HandleFunc("/sse", longpoll.SSEHandler)
 	log.Println("Listening on port 8080")
 	log.Fatal(http.ListenAndServe(":8080", nil))
 }
@@ -1,6 +1,16 @@
 package longpoll
 
-import "net/http"
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/frncscsrcc/resthelper"
+)
 
 // ContextStruct is a struct that could be used to inject parameters in the
 // client request
@@ -10,42 +20,208 @@ type ContextStruct struct {
 	SessionID      string
 }
 
-func getFeeds(r *http.Request) (feeds []string) {
-	var ok bool
+// maxBodySize is the maximum size of the JSON body with the parameters of a
+// request, a longer body is ignored
+const maxBodySize = 1 << 20
+
+// requestParams contains the parameters of a request. It is also the JSON body
+// a client could send instead of passing the parameters in the query-string
+// (the keys are matched without regard to case, so the previous
+// subscriptionID key is still accepted).
+type requestParams struct {
+	SubscriptionID string   `json:"subscriptionId"`
+	Feeds          []string `json:"feeds"`
+	EventIDs       []int    `json:"eventIDs"`
+}
+
+// paramSources returns the parameters passed in the context, in the headers
+// (X-Subscription-ID and X-Feeds, unless they were renamed), in the
+// query-string and in the JSON body, in order of priority: a parameter is
+// taken from the first source that contains it.
+func (lp *LongPoll) paramSources(r *http.Request) []requestParams {
+	lp.mutex.RLock()
+	subscriptionIDHeader, feedsHeader := lp.subscriptionIDHeader, lp.feedsHeader
+	lp.mutex.RUnlock()
 
-	// Search in the context
-	contextStruct, assertOK := r.Context().Value(ContextStructIdentifier).(ContextStruct)
-	if assertOK && len(contextStruct.Feeds) > 0 {
-		return contextStruct.Feeds
+	contextStruct, _ := r.Context().Value(ContextStructIdentifier).(ContextStruct)
+	query := r.URL.Query()
+	return []requestParams{
+		{SubscriptionID: contextStruct.SubscriptionID, Feeds: contextStruct.Feeds},
+		{SubscriptionID: strings.TrimSpace(r.Header.Get(subscriptionIDHeader)), Feeds: splitFeeds(r.Header.Get(feedsHeader))},
+		{SubscriptionID: query.Get("subscriptionID"), Feeds: query["feed"]},
+		getBody(r),
 	}
+}
 
-	// Search in URL
-	feeds, ok = r.URL.Query()["feed"]
-	if ok == true {
-		return feeds
+// splitFeeds returns the feeds of a comma separated list
+func splitFeeds(list string) []string {
+	var feeds []string
+	for _, feed := range strings.Split(list, ",") {
+		if feed = strings.TrimSpace(feed); feed != "" {
+			feeds = append(feeds, feed)
+		}
 	}
 	return feeds
+}
 
-	// Search in body
-	// TODO
+// getFeeds returns the feeds passed in the request
+func (lp *LongPoll) getFeeds(r *http.Request) []string {
+	for _, params := range lp.paramSources(r) {
+		if len(params.Feeds) > 0 {
+			return params.Feeds
+		}
+	}
+	return nil
 }
 
-func getSubscriptionID(r *http.Request) (subscriptionID string) {
-	var ok bool
+// getSubscriptionID returns the subscriptionID passed in the request
+func (lp *LongPoll) getSubscriptionID(r *http.Request) string {
+	for _, params := range lp.paramSources(r) {
+		if params.SubscriptionID != "" {
+			return params.SubscriptionID
+		}
+	}
+	return ""
+}
 
-	// Search in the context
-	contextStruct, assertOK := r.Context().Value("contextStruct").(ContextStruct)
-	if assertOK && len(contextStruct.SubscriptionID) > 0 {
-		return contextStruct.SubscriptionID
+// getRequestID returns the ID of the request, passed in the X-Request-ID
+// header or generated, and sends it back in the response header. It returns
+// the same ID when it is called again for the same response.
+func getRequestID(w http.ResponseWriter, r *http.Request) string {
+	if requestID := w.Header().Get(RequestIDHeader); requestID != "" {
+		return requestID
+	}
+	requestID := r.Header.Get(RequestIDHeader)
+	if requestID == "" || len(requestID) > maxRequestIDLength || strconv.CanBackquote(requestID) == false {
+		requestID = resthelper.GetNewToken(16)
 	}
+	w.Header().Set(RequestIDHeader, requestID)
+	return requestID
+}
 
-	// Search in URL
-	subscriptionIDs, ok := r.URL.Query()["subscriptionID"]
-	if ok == true && len(subscriptionIDs) > 0 {
-		return subscriptionIDs[0]
+// getLastEventID returns the lastEventID passed in the query-string, or in the
+// Last-Event-ID header sent by the browsers reconnecting an SSE stream, if any
+func getLastEventID(r *http.Request) (lastEventID int, ok bool) {
+	value := r.URL.Query().Get("lastEventID")
+	if value == "" {
+		value = r.Header.Get("Last-Event-ID")
+	}
+	if value == "" {
+		return 0, false
+	}
+	lastEventID, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, false
+	}
+	return lastEventID, true
+}
+
+// getLimit returns the maximum number of events passed in the query-string,
+// if any
+func getLimit(r *http.Request) (limit int, ok bool) {
+	value := r.URL.Query().Get("limit")
+	if value == "" {
+		return 0, false
 	}
-	return subscriptionID
+	limit, err := strconv.Atoi(value)
+	if err != nil || limit <= 0 {
+		return 0, false
+	}
+	return limit, true
+}
+
+// getBacklog returns the number of past events requested in the
+// query-string, if any
+func getBacklog(r *http.Request) (backlog int, ok bool) {
+	value := r.URL.Query().Get("backlog")
+	if value == "" {
+		return 0, false
+	}
+	backlog, err := strconv.Atoi(value)
+	if err != nil || backlog <= 0 {
+		return 0, false
+	}
+	return backlog, true
+}
 
+// getWait checks if a listen request should wait for the events. It is true
+// unless wait=false is passed in the query-string.
+func getWait(r *http.Request) bool {
+	return r.URL.Query().Get("wait") != "false"
+}
+
+// getGroup returns the consumer group passed in the query-string, if any
+func getGroup(r *http.Request) string {
+	return r.URL.Query().Get("group")
+}
+
+// getName returns the display name passed in the query-string, if any
+func getName(r *http.Request) string {
+	return strings.TrimSpace(r.URL.Query().Get("name"))
+}
+
+// getGrouped checks if grouped=true is passed in the query-string
+func getGrouped(r *http.Request) bool {
+	return r.URL.Query().Get("grouped") == "true"
+}
+
+// getKeepEvents checks if keepEvents=true is passed in the query-string
+func getKeepEvents(r *http.Request) bool {
+	return r.URL.Query().Get("keepEvents") == "true"
+}
+
+// getEventIDs returns the event IDs passed in the body or in the query-string
+func getEventIDs(r *http.Request) (eventIDs []int, ok bool) {
 	// Search in body
-	// TODO
+	if body := getBody(r); len(body.EventIDs) > 0 {
+		return body.EventIDs, true
+	}
+
+	// Search in URL
+	for _, value := range r.URL.Query()["eventID"] {
+		eventID, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, false
+		}
+		eventIDs = append(eventIDs, eventID)
+	}
+	return eventIDs, len(eventIDs) > 0
+}
+
+// withBody returns a copy of the request that carries its JSON body, decoded
+// only once: the following getBody calls use it instead of reading the body
+// again.
+func withBody(r *http.Request) *http.Request {
+	if _, decoded := r.Context().Value(bodyIdentifier).(requestParams); decoded == true {
+		return r
+	}
+	return r.WithContext(context.WithValue(r.Context(), bodyIdentifier, readBody(r)))
+}
+
+// getBody returns the JSON body of the request, decoded by withBody or, if the
+// request does not carry it, decoded now
+func getBody(r *http.Request) requestParams {
+	if body, decoded := r.Context().Value(bodyIdentifier).(requestParams); decoded == true {
+		return body
+	}
+	return readBody(r)
+}
+
+// readBody decodes the JSON body of the request, if any. It reads at most
+// maxBodySize bytes, and ignores a longer body. The read bytes are restored,
+// so the body can be read again later.
+func readBody(r *http.Request) (body requestParams) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return body
+	}
+	content, err := io.ReadAll(io.LimitReader(r.Body, maxBodySize+1))
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(content), r.Body), r.Body}
+	if err != nil || len(content) == 0 || len(content) > maxBodySize {
+		return body
+	}
+	json.Unmarshal(content, &body)
+	return body
 }
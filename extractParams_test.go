@@ -0,0 +1,153 @@
+package longpoll
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestContextParams(t *testing.T) {
+	lp := New()
+	lp.AddFeeds([]string{"feed1", "feed2"})
+	contextStruct := ContextStruct{SubscriptionID: "from-context", Feeds: []string{"feed2"}}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/subscribe?feed=feed1", nil)
+	lp.SubscribeHandler(w, r.WithContext(NewContext(r.Context(), contextStruct)))
+	if w.Code != 200 {
+		t.Fatalf("subscribe: %d %s", w.Code, w.Body.String())
+	}
+	if info, exists := lp.GetSubscription("from-context"); exists == false || len(info.Feeds) != 1 || info.Feeds[0] != "feed2" {
+		t.Fatalf("subscription from the context: %+v %t", info, exists)
+	}
+
+	lp.NewEvent("feed2", "from feed2")
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("GET", "/listen", nil)
+	lp.ListenHandler(w, r.WithContext(NewContext(r.Context(), contextStruct)))
+	if w.Code != 200 || strings.Contains(w.Body.String(), "from feed2") == false {
+		t.Fatalf("listen: %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestBodyParams(t *testing.T) {
+	lp := New()
+	r := httptest.NewRequest("POST", "/listen", strings.NewReader(`{"subscriptionID":"from-body","feeds":["feed1"]}`))
+	r = withBody(r)
+	r.Body = io.NopCloser(strings.NewReader(`{"subscriptionID":"read-again"}`))
+	if subscriptionID := lp.getSubscriptionID(r); subscriptionID != "from-body" {
+		t.Fatalf("the body was decoded again: %s", subscriptionID)
+	}
+	if feeds := lp.getFeeds(r); len(feeds) != 1 || feeds[0] != "feed1" {
+		t.Fatalf("feeds: %v", feeds)
+	}
+
+	content := `{"subscriptionID":"too-long","feeds":["` + strings.Repeat("x", maxBodySize) + `"]}`
+	r = httptest.NewRequest("POST", "/listen", strings.NewReader(content))
+	if subscriptionID := lp.getSubscriptionID(r); subscriptionID != "" {
+		t.Fatalf("a body longer than %d bytes was decoded", maxBodySize)
+	}
+	if restored, _ := io.ReadAll(r.Body); string(restored) != content {
+		t.Fatal("the body was not restored")
+	}
+}
+
+func TestParamSources(t *testing.T) {
+	lp := New()
+	body := `{"subscriptionID":"body","feeds":["body1"]}`
+	for source, r := range map[string]*http.Request{
+		"query":  httptest.NewRequest("GET", "/listen?subscriptionID=query&feed=query1", nil),
+		"body":   httptest.NewRequest("POST", "/listen", strings.NewReader(body)),
+		"header": httptest.NewRequest("GET", "/listen", nil),
+	} {
+		if source == "header" {
+			r.Header.Set(SubscriptionIDHeader, "header")
+			r.Header.Set(FeedsHeader, "header1, header2")
+		}
+		if subscriptionID := lp.getSubscriptionID(r); subscriptionID != source {
+			t.Fatalf("%s: subscriptionID %q", source, subscriptionID)
+		}
+		if feeds := lp.getFeeds(r); len(feeds) == 0 || feeds[0] != source+"1" {
+			t.Fatalf("%s: feeds %v", source, feeds)
+		}
+	}
+
+	r := httptest.NewRequest("POST", "/listen?subscriptionID=query", strings.NewReader(body))
+	r.Header.Set(FeedsHeader, "header1")
+	if lp.getSubscriptionID(r) != "query" || lp.getFeeds(r)[0] != "header1" {
+		t.Fatal("the headers and the query-string must come before the body")
+	}
+	r = r.WithContext(NewContext(r.Context(), ContextStruct{SubscriptionID: "context"}))
+	if lp.getSubscriptionID(r) != "context" || lp.getFeeds(r)[0] != "header1" {
+		t.Fatal("the context must come first")
+	}
+	if lp.getSubscriptionID(httptest.NewRequest("GET", "/listen", nil)) != "" {
+		t.Fatal("subscriptionID without sources")
+	}
+}
+
+func TestCustomHeaders(t *testing.T) {
+	lp := New()
+	lp.AddFeed("feed1")
+	lp.SetSubscriptionIDHeader("X-Client")
+	lp.SetFeedsHeader("X-Topics")
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/subscribe", nil)
+	r.Header.Set("X-Client", "client1")
+	r.Header.Set("X-Topics", "feed1")
+	r.Header.Set(SubscriptionIDHeader, "ignored")
+	lp.SubscribeHandler(w, r)
+	if w.Code != 200 {
+		t.Fatalf("subscribe: %d %s", w.Code, w.Body.String())
+	}
+	if _, exists := lp.GetSubscription("client1"); exists == false {
+		t.Fatal("subscriptionID not read from the custom header")
+	}
+
+	lp.NewEvent("feed1", "event1")
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("GET", "/listen", nil)
+	r.Header.Set("X-Client", "client1")
+	lp.ListenHandler(w, r)
+	if w.Code != 200 || strings.Contains(w.Body.String(), "event1") == false {
+		t.Fatalf("listen: %d %s", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("GET", "/subscribeAndListen?feed=feed1", nil)
+	lp.SetTimeout(10 * time.Millisecond)
+	lp.SubscribeAndListenHandler(w, r)
+	if w.Header().Get("X-Client") == "" || w.Header().Get(SubscriptionIDHeader) != "" {
+		t.Fatalf("subscriptionID not sent in the custom header: %v", w.Header())
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	lp := New()
+	lp.AddFeed("feed1")
+	subscriptionID := subscribe(t, lp, "feed=feed1")
+
+	r := httptest.NewRequest("GET", "/listen?wait=false&subscriptionID="+subscriptionID, nil)
+	r.Header.Set(RequestIDHeader, "listen-1")
+	w := httptest.NewRecorder()
+	lp.ListenHandler(w, r)
+	if requestID := w.Header().Get(RequestIDHeader); requestID != "listen-1" {
+		t.Fatalf("request ID not sent back: %q", requestID)
+	}
+	w = httptest.NewRecorder()
+	lp.ListenHandler(w, httptest.NewRequest("GET", "/listen", nil))
+	if w.Header().Get(RequestIDHeader) == "" {
+		t.Fatal("request ID not generated")
+	}
+
+	r = httptest.NewRequest("POST", "/publish", strings.NewReader(`{"feed":"feed1","data":1}`))
+	r.Header.Set(RequestIDHeader, "publish-1")
+	lp.PublishHandler(httptest.NewRecorder(), r)
+	if events := decodeEvents(t, listen(lp, "subscriptionID="+subscriptionID)).Events; len(events) != 1 || events[0].RequestID != "publish-1" {
+		t.Fatalf("request ID of the publish not delivered: %+v", events)
+	}
+}
@@ -0,0 +1,60 @@
+package longpoll
+
+import "sort"
+
+// setClientGroup puts a client in a consumer group, or removes it from its
+// group if group is empty. It must be called holding the lock.
+func (lp *LongPoll) setClientGroup(subscriptionID string, group string) {
+	if previous, ok := lp.globalClientToGroup[subscriptionID]; ok == true {
+		if previous == group {
+			return
+		}
+		delete(lp.globalGroupToClients[previous], subscriptionID)
+		if len(lp.globalGroupToClients[previous]) == 0 {
+			delete(lp.globalGroupToClients, previous)
+			delete(lp.groupCursors, previous)
+		}
+		delete(lp.globalClientToGroup, subscriptionID)
+	}
+	if group == "" {
+		return
+	}
+	if _, exists := lp.globalGroupToClients[group]; exists == false {
+		lp.globalGroupToClients[group] = make(clientExist)
+	}
+	lp.globalGroupToClients[group][subscriptionID] = true
+	lp.globalClientToGroup[subscriptionID] = group
+}
+
+// enqueueAll queues an event for the clients, but only for one member of
+// every consumer group among them: the events are assigned to the members in
+// turn, skipping the ones that do not accept the event (because of their
+// filter, or of their full queue). It returns the clients that must be
+// notified. It must be called holding the lock.
+func (lp *LongPoll) enqueueAll(clients clientExist, event Event) clientExist {
+	waitingClients := make(clientExist)
+	groups := make(map[string][]string)
+	for client := range clients {
+		if group, ok := lp.globalClientToGroup[client]; ok == true {
+			groups[group] = append(groups[group], client)
+			continue
+		}
+		if lp.enqueue(client, event) == true {
+			waitingClients[client] = true
+		}
+	}
+
+	for group, members := range groups {
+		sort.Strings(members)
+		cursor := lp.groupCursors[group]
+		for i := range members {
+			member := members[(cursor+i)%len(members)]
+			if lp.enqueue(member, event) == true {
+				waitingClients[member] = true
+				break
+			}
+		}
+		lp.groupCursors[group] = cursor + 1
+	}
+	return waitingClients
+}
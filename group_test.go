@@ -0,0 +1,35 @@
+package longpoll
+
+import "testing"
+
+func TestConsumerGroup(t *testing.T) {
+	lp := New()
+	lp.AddFeed("feed1")
+	member1 := subscribe(t, lp, "feed=feed1&group=workers")
+	member2 := subscribe(t, lp, "feed=feed1&group=workers")
+	alone := subscribe(t, lp, "feed=feed1")
+	for i := 0; i < 10; i++ {
+		lp.NewEvent("feed1", i)
+	}
+
+	events1, events2 := lp.DrainEvents(member1), lp.DrainEvents(member2)
+	if len(events1) != 5 || len(events2) != 5 {
+		t.Fatalf("expected 5 events per member, got %d and %d", len(events1), len(events2))
+	}
+	received := make(map[int]bool)
+	for _, event := range append(events1, events2...) {
+		if received[event.ID] == true {
+			t.Fatalf("event %d received by both the members", event.ID)
+		}
+		received[event.ID] = true
+	}
+	if events := lp.DrainEvents(alone); len(events) != 10 {
+		t.Fatalf("expected 10 events outside the group, got %d", len(events))
+	}
+
+	lp.Unsubscribe(member2, nil)
+	lp.NewEvent("feed1", 10)
+	if events := lp.DrainEvents(member1); len(events) != 1 {
+		t.Fatalf("expected the event for the last member, got %+v", events)
+	}
+}
@@ -0,0 +1,82 @@
+package longpoll
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// HealthResponse is the response of HealthHandler for a healthy instance
+type HealthResponse struct {
+	Status string `json:"status"`
+}
+
+// HealthHandler checks the consistency of the internal state, and responds
+// with 200 and {"status": "ok"} if it holds. Otherwise it responds with 503,
+// and the message reports only the number of problems found: the problems
+// (for example a connection without its comunication channel, a listening
+// client without a connection or a feed subscribed by a client that does not
+// exist) are written to the log, since they contain the subscriptionIDs. It
+// responds with 503 also during the shutdown. The check walks all the
+// subscriptions of all the feeds under the read lock, so its cost grows with
+// the number of subscriptions: it is safe to call it concurrently with the
+// handlers, but a probe should not call it more than every few seconds.
+func (lp *LongPoll) HealthHandler(w http.ResponseWriter, r *http.Request) {
+	getRequestID(w, r)
+
+	problems := lp.checkConsistency()
+	if len(problems) > 0 {
+		lp.logger.Printf("Health check failed: %s\n", strings.Join(problems, "; "))
+		sendError(w, 503, ErrorServiceUnavailable, fmt.Sprintf("Inconsistent state: %d problems found", len(problems)))
+		return
+	}
+	lp.sendResponse(w, r, HealthResponse{Status: "ok"})
+}
+
+// checkConsistency returns the invariants of the internal maps and counters
+// that do not hold, if any
+func (lp *LongPoll) checkConsistency() []string {
+	lp.mutex.RLock()
+	defer lp.mutex.RUnlock()
+
+	var problems []string
+	if lp.shutdown == true {
+		problems = append(problems, "shutting down")
+	}
+	if lp.publishedEvents < 0 || lp.deliveredEvents < 0 {
+		problems = append(problems, "negative event counters")
+	}
+	for client, connection := range lp.globalClientToConnection {
+		if _, exists := lp.globalClients[client]; exists == false {
+			problems = append(problems, fmt.Sprintf("connection %d of unknown client %s", connection, client))
+		}
+		if _, exists := lp.globalConnectionChannel[connection]; exists == false {
+			problems = append(problems, fmt.Sprintf("connection %d of %s without channel", connection, client))
+		}
+		if connection <= 0 || connection > lp.globalLastConnection {
+			problems = append(problems, fmt.Sprintf("invalid connection %d of %s", connection, client))
+		}
+	}
+	for client, pending := range lp.globalClients {
+		if _, hasConnection := lp.globalClientToConnection[client]; pending == true && hasConnection == false {
+			problems = append(problems, fmt.Sprintf("client %s listening without connection", client))
+		}
+	}
+	for _, feedClients := range []feedToClients{lp.globalFeedToClients, lp.globalPatternToClients, lp.globalGroupToClients} {
+		for feed, clients := range feedClients {
+			for client := range clients {
+				if _, exists := lp.globalClients[client]; exists == false {
+					problems = append(problems, fmt.Sprintf("unknown client %s in %s", client, feed))
+				}
+			}
+		}
+	}
+	for _, queues := range []clientToNewEvents{lp.globalClientToNewEvents, lp.globalClientToInFlight} {
+		for client := range queues {
+			if _, exists := lp.globalClients[client]; exists == false {
+				problems = append(problems, fmt.Sprintf("events queued for unknown client %s", client))
+			}
+		}
+	}
+	return problems
+}
@@ -0,0 +1,43 @@
+package longpoll
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHealthHandler(t *testing.T) {
+	lp := New()
+	lp.SetLogger(nil)
+	lp.AddFeed("feed1")
+	subscribe(t, lp, "feed=feed1")
+
+	w := httptest.NewRecorder()
+	lp.HealthHandler(w, httptest.NewRequest("GET", "/healthz", nil))
+	if w.Code != 200 {
+		t.Fatalf("healthy instance: %d %s", w.Code, w.Body.String())
+	}
+
+	lp.mutex.Lock()
+	lp.globalClientToConnection["ghost-subscription"] = 99
+	lp.mutex.Unlock()
+	w = httptest.NewRecorder()
+	lp.HealthHandler(w, httptest.NewRequest("GET", "/healthz", nil))
+	if w.Code != 503 {
+		t.Fatalf("inconsistent state: expected 503, got %d", w.Code)
+	}
+	if strings.Contains(w.Body.String(), "ghost-subscription") == true {
+		t.Fatalf("the response contains the subscriptionID: %s", w.Body.String())
+	}
+	lp.mutex.Lock()
+	delete(lp.globalClientToConnection, "ghost-subscription")
+	lp.mutex.Unlock()
+
+	lp.Shutdown(context.Background())
+	w = httptest.NewRecorder()
+	lp.HealthHandler(w, httptest.NewRequest("GET", "/healthz", nil))
+	if w.Code != 503 {
+		t.Fatalf("shutdown: expected 503, got %d", w.Code)
+	}
+}
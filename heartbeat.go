@@ -0,0 +1,91 @@
+package longpoll
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// heartbeatWriter is a http.ResponseWriter that periodically writes a
+// whitespace (ignored by the JSON parsers) while a listen request waits, so
+// the proxies do not close an idle connection. After the first heartbeat the
+// status code is already sent, so the following calls to WriteHeader are
+// ignored and the outcome of the request is only in the body.
+type heartbeatWriter struct {
+	http.ResponseWriter
+	mutex   sync.Mutex
+	started bool
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+// startHeartbeat starts writing heartbeats on w, every interval measured by
+// the clock. It returns nil if w can not be flushed.
+func startHeartbeat(w http.ResponseWriter, interval time.Duration, clock Clock) *heartbeatWriter {
+	if _, ok := w.(http.Flusher); ok == false {
+		return nil
+	}
+	hw := &heartbeatWriter{
+		ResponseWriter: w,
+		stop:           make(chan struct{}),
+		stopped:        make(chan struct{}),
+	}
+	go hw.run(interval, clock)
+	return hw
+}
+
+func (hw *heartbeatWriter) run(interval time.Duration, clock Clock) {
+	defer close(hw.stopped)
+
+	for {
+		select {
+		case <-hw.stop:
+			return
+		case <-clock.After(interval):
+			hw.mutex.Lock()
+			if hw.started == false {
+				hw.started = true
+				hw.Header().Set("Content-Type", "application/json")
+				hw.ResponseWriter.WriteHeader(http.StatusOK)
+			}
+			hw.ResponseWriter.Write([]byte(" "))
+			hw.ResponseWriter.(http.Flusher).Flush()
+			hw.mutex.Unlock()
+		}
+	}
+}
+
+// Stop stops the heartbeats, and waits for the goroutine writing them to exit
+func (hw *heartbeatWriter) Stop() {
+	close(hw.stop)
+	<-hw.stopped
+}
+
+// headerSent checks if the status code and the headers were already sent
+func (hw *heartbeatWriter) headerSent() bool {
+	hw.mutex.Lock()
+	defer hw.mutex.Unlock()
+
+	return hw.started
+}
+
+// WriteHeader sends the status code, unless a heartbeat was already sent
+func (hw *heartbeatWriter) WriteHeader(statusCode int) {
+	hw.mutex.Lock()
+	defer hw.mutex.Unlock()
+
+	if hw.started == true {
+		return
+	}
+	hw.started = true
+	hw.ResponseWriter.WriteHeader(statusCode)
+}
+
+// Write writes the body of the response
+func (hw *heartbeatWriter) Write(data []byte) (int, error) {
+	hw.mutex.Lock()
+	defer hw.mutex.Unlock()
+
+	hw.started = true
+	return hw.ResponseWriter.Write(data)
+}
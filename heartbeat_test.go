@@ -0,0 +1,31 @@
+package longpoll
+
+import (
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHeartbeat(t *testing.T) {
+	lp := New()
+	lp.AddFeed("feed1")
+	lp.SetTimeout(150 * time.Millisecond)
+	subscriptionID := subscribe(t, lp, "feed=feed1")
+
+	w := listen(lp, "subscriptionID="+subscriptionID)
+	if strings.HasPrefix(w.Body.String(), " ") == true {
+		t.Fatalf("heartbeat sent by default: %q", w.Body.String())
+	}
+
+	lp.SetHeartbeatInterval(20 * time.Millisecond)
+	goroutines := runtime.NumGoroutine()
+	w = listen(lp, "subscriptionID="+subscriptionID)
+	body := w.Body.String()
+	if strings.HasPrefix(body, "  ") == false || strings.Contains(body, string(ErrorRequestTimeout)) == false {
+		t.Fatalf("expected the heartbeats and then the timeout, got %d %q", w.Code, body)
+	}
+	if running := runtime.NumGoroutine(); running > goroutines {
+		t.Fatalf("%d goroutines running after the listen request, %d before", running, goroutines)
+	}
+}
@@ -0,0 +1,169 @@
+package longpoll
+
+import (
+	"context"
+	"errors"
+)
+
+// Subscribe creates an in-process subscription: the events published on the
+// feeds (or on the feeds matching the patterns) are delivered on the returned
+// channel, without the HTTP round-trip. The events are queued while the
+// channel is not read, as for a client that is not listening. Unsubscribe
+// removes the subscription and its queue, and closes the channel, that is
+// closed also at the shutdown.
+func (lp *LongPoll) Subscribe(feeds []string) (string, <-chan Event, error) {
+	return lp.SubscribeWithFilter(feeds, nil)
+}
+
+// EventFilter decides if an event must be delivered to a subscriber. It is
+// called holding the internal lock, so it must be fast and it must not call
+// the methods of LongPoll.
+type EventFilter func(event Event) bool
+
+// SubscribeWithFilter creates an in-process subscription, like Subscribe, but
+// only the events accepted by the filter are queued for it: the others are
+// discarded during the fan-out. A nil filter accepts all the events.
+func (lp *LongPoll) SubscribeWithFilter(feeds []string, filter EventFilter) (string, <-chan Event, error) {
+	feeds = lp.resolveAliases(uniqueFeeds(feeds))
+	if len(feeds) == 0 {
+		return "", nil, errors.New("missing feed")
+	}
+
+	subscriptionID := lp.newSubscriptionID()
+
+	lp.mutex.Lock()
+
+	if lp.shutdown == true {
+		lp.mutex.Unlock()
+		return "", nil, errors.New("service unavailable")
+	}
+
+	for _, feed := range feeds {
+		if isPattern(feed) {
+			if isValidPattern(feed) == false {
+				lp.mutex.Unlock()
+				return "", nil, errors.New("feed pattern " + feed + " is not valid")
+			}
+			continue
+		}
+		if lp.feedAvailable(feed) == false {
+			lp.mutex.Unlock()
+			return "", nil, errors.New("feed " + feed + " is not available")
+		}
+	}
+
+	lp.addClient(subscriptionID, feeds)
+	if filter != nil {
+		lp.globalClientToFilter[subscriptionID] = filter
+	}
+
+	// Shutdown waits for the subscriber to be closed
+	lp.connections.Add(1)
+
+	connection, comunicationChannel, _ := lp.openConnection(subscriptionID)
+	lp.mutex.Unlock()
+
+	receiver := make(chan Event)
+	go lp.deliverInProcess(subscriptionID, connection, comunicationChannel, receiver)
+
+	return subscriptionID, receiver, nil
+}
+
+// deliverInProcess sends the events of an in-process subscription on the
+// receiver channel, until the subscription is removed or the server shuts
+// down. The signals are received also while the receiver is not read, so an
+// idle subscriber does not block the notifications.
+func (lp *LongPoll) deliverInProcess(subscriptionID string, connection int, comunicationChannel chan string, receiver chan Event) {
+	defer lp.connections.Done()
+	defer close(receiver)
+
+	resend := true
+	for {
+		// The signal is lost if the subscription is removed, or the server is
+		// shutting down, while the previous events are being delivered
+		lp.mutex.Lock()
+		if _, exists := lp.globalClients[subscriptionID]; exists == false || lp.shutdown == true {
+			lp.closeConnection(subscriptionID, connection)
+			lp.mutex.Unlock()
+			return
+		}
+		events, _ := lp.fetchEvents(subscriptionID, resend, 0)
+		resend = false
+		if lp.globalClientToConnection[subscriptionID] == connection {
+			lp.globalClients[subscriptionID] = true
+		}
+		lp.mutex.Unlock()
+		events = lp.transform(subscriptionID, events)
+
+		operation := "DONE"
+		for _, event := range events {
+			for delivered := false; delivered == false && operation == "DONE"; {
+				select {
+				case receiver <- event:
+					delivered = true
+				case operation = <-comunicationChannel:
+				}
+			}
+		}
+		if operation == "DONE" && len(events) == 0 {
+			operation = <-comunicationChannel
+		}
+		if operation == "DONE" {
+			continue
+		}
+
+		lp.logger.Printf("In-process subscriber %s (%d) received signal %s\n", subscriptionID, connection, operation)
+		lp.mutex.Lock()
+		lp.closeConnection(subscriptionID, connection)
+		lp.mutex.Unlock()
+		return
+	}
+}
+
+// Listen is the in-process version of ListenHandler: it returns the events
+// queued for a subscription created with SubscribeHandler (the events of
+// Subscribe are delivered on its channel), or waits for the next ones, until
+// the listen timeout. It returns ErrRequestTimeout if no event arrives in
+// time, or an empty list if the initial delay (see SetInitialDelay) elapses
+// first, the context error if the context is done first, and the errors of
+// Stream.Next. As for a listen request, it replaces the open connection of
+// the subscription, if any.
+func (lp *LongPoll) Listen(ctx context.Context, subscriptionID string) ([]Event, error) {
+	if subscriptionID == "" {
+		return nil, ErrMissingSubscriptionID
+	}
+	stream, err := lp.openStream(subscriptionID, 0, false)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+
+	lp.mutex.RLock()
+	timeout := lp.clientTimeout(subscriptionID)
+	emptyOnTimeout := false
+	if lp.initialDelay > 0 && lp.initialDelay < timeout {
+		timeout = lp.initialDelay
+		emptyOnTimeout = true
+	}
+	lp.mutex.RUnlock()
+
+	// The listen context is canceled by the timeout of the Clock
+	listenCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-lp.clock.After(timeout):
+			cancel()
+		case <-listenCtx.Done():
+		}
+	}()
+
+	events, err := stream.Next(listenCtx)
+	if errors.Is(err, context.Canceled) && ctx.Err() == nil {
+		if emptyOnTimeout == true {
+			return make([]Event, 0), nil
+		}
+		return nil, ErrRequestTimeout
+	}
+	return events, err
+}
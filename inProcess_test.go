@@ -0,0 +1,88 @@
+package longpoll
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSubscribeWithFilter(t *testing.T) {
+	lp := New()
+	lp.AddFeed("feed1")
+	even := func(event Event) bool { return event.Data.(int)%2 == 0 }
+	subscriptionID, receiver, err := lp.SubscribeWithFilter([]string{"feed1"}, even)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 1; i <= 4; i++ {
+		lp.NewEvent("feed1", i)
+	}
+	lp.mutex.RLock()
+	for _, eventID := range lp.globalClientToNewEvents[subscriptionID] {
+		if event, _ := lp.eventStore.Load(eventID); even(event) == false {
+			t.Errorf("event %+v queued", event)
+		}
+	}
+	lp.mutex.RUnlock()
+
+	for _, expected := range []int{2, 4} {
+		select {
+		case event := <-receiver:
+			if event.Data != expected {
+				t.Fatalf("expected %d, got %+v", expected, event)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("event %d not received", expected)
+		}
+	}
+	lp.Unsubscribe(subscriptionID, nil)
+	if event, open := <-receiver; open == true {
+		t.Fatalf("filtered event received: %+v", event)
+	}
+}
+
+func TestListen(t *testing.T) {
+	lp := New()
+	lp.SetLogger(nil)
+	lp.AddFeed("feed1")
+	lp.SetTimeout(100 * time.Millisecond)
+	subscriptionID := subscribe(t, lp, "feed=feed1")
+
+	lp.NewEvent("feed1", 1)
+	if events, err := lp.Listen(context.Background(), subscriptionID); err != nil || len(events) != 1 {
+		t.Fatalf("queued event: %+v %v", events, err)
+	}
+
+	done := make(chan []Event)
+	go func() {
+		events, _ := lp.Listen(context.Background(), subscriptionID)
+		done <- events
+	}()
+	waitListening(t, lp, subscriptionID)
+	lp.NewEvent("feed1", 2)
+	if events := <-done; len(events) != 1 || events[0].Data != 2 {
+		t.Fatalf("expected the new event, got %+v", events)
+	}
+
+	if _, err := lp.Listen(context.Background(), subscriptionID); err != ErrRequestTimeout {
+		t.Fatalf("expected ErrRequestTimeout, got %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := lp.Listen(ctx, subscriptionID); errors.Is(err, context.DeadlineExceeded) == false {
+		t.Fatalf("expected the context error, got %v", err)
+	}
+	lp.SetInitialDelay(10 * time.Millisecond)
+	if events, err := lp.Listen(context.Background(), subscriptionID); err != nil || events == nil || len(events) != 0 {
+		t.Fatalf("expected an empty list after the initial delay, got %+v %v", events, err)
+	}
+	lp.SetInitialDelay(0)
+	if _, err := lp.Listen(context.Background(), "unknown"); err != ErrUnknownSubscription {
+		t.Fatalf("expected ErrUnknownSubscription, got %v", err)
+	}
+	if info, _ := lp.GetSubscription(subscriptionID); info.Listening == true {
+		t.Fatalf("subscription still listening: %+v", info)
+	}
+}
@@ -0,0 +1,54 @@
+package longpoll
+
+// legacySubscriptionResponse is SubscriptionResponse with the JSON keys used
+// before the camelCase ones
+type legacySubscriptionResponse struct {
+	SubscriptionID string
+	Feeds          []string
+}
+
+// legacyAckResponse is AckResponse with the JSON keys used before the
+// camelCase ones
+type legacyAckResponse struct {
+	SubscriptionID string
+	InFlight       []int
+}
+
+// legacySubscribeAndListenResponse is SubscribeAndListenResponse with the
+// JSON key used before the camelCase one
+type legacySubscribeAndListenResponse struct {
+	SubscriptionID string `json:"subscriptionID"`
+	EventResponse
+}
+
+// SetLegacyKeys makes the responses use the JSON keys of the previous
+// versions instead of the camelCase ones, for the clients not yet migrated:
+// SubscriptionID, Feeds and InFlight in the subscribe, unsubscribe and ack
+// responses, and subscriptionID in the subscribe and listen one. It is off by
+// default.
+func (lp *LongPoll) SetLegacyKeys(legacy bool) {
+	lp.mutex.Lock()
+	lp.legacyKeys = legacy
+	lp.mutex.Unlock()
+}
+
+// legacyResponse returns v with the legacy JSON keys, if they are enabled and
+// v has them, or v itself
+func (lp *LongPoll) legacyResponse(v interface{}) interface{} {
+	lp.mutex.RLock()
+	legacy := lp.legacyKeys
+	lp.mutex.RUnlock()
+	if legacy == false {
+		return v
+	}
+
+	switch response := v.(type) {
+	case SubscriptionResponse:
+		return legacySubscriptionResponse(response)
+	case AckResponse:
+		return legacyAckResponse(response)
+	case SubscribeAndListenResponse:
+		return legacySubscribeAndListenResponse(response)
+	}
+	return v
+}
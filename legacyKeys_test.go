@@ -0,0 +1,67 @@
+package longpoll
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// responseKeys returns the sorted keys of the JSON object in the response
+func responseKeys(t *testing.T, w *httptest.ResponseRecorder) string {
+	var object map[string]json.RawMessage
+	if err := json.Unmarshal(w.Body.Bytes(), &object); err != nil {
+		t.Fatalf("Can not decode %q: %s", w.Body.String(), err)
+	}
+	keys := []string{}
+	for key := range object {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return strings.Join(keys, ",")
+}
+
+func TestResponseKeys(t *testing.T) {
+	for _, test := range []struct {
+		legacy             bool
+		subscription       string
+		ack                string
+		subscribeAndListen string
+	}{
+		{false, "feeds,subscriptionId", "inFlight,subscriptionId", "count,events,hasMore,lastEventID,subscriptionId"},
+		{true, "Feeds,SubscriptionID", "InFlight,SubscriptionID", "count,events,hasMore,lastEventID,subscriptionID"},
+	} {
+		lp := New()
+		lp.SetLogger(nil)
+		lp.SetAckMode(true)
+		lp.SetLegacyKeys(test.legacy)
+		lp.AddFeed("feed1")
+
+		w := httptest.NewRecorder()
+		lp.SubscribeHandler(w, httptest.NewRequest("GET", "/subscribe?feed=feed1", nil))
+		if keys := responseKeys(t, w); keys != test.subscription {
+			t.Errorf("Legacy %t: subscribe keys %s, expected %s", test.legacy, keys, test.subscription)
+		}
+		id := subscribe(t, lp, "feed=feed1")
+
+		w = httptest.NewRecorder()
+		lp.UnsubscribeHandler(w, httptest.NewRequest("GET", "/unsubscribe?feed=feed1&subscriptionID="+id, nil))
+		if keys := responseKeys(t, w); keys != test.subscription {
+			t.Errorf("Legacy %t: unsubscribe keys %s, expected %s", test.legacy, keys, test.subscription)
+		}
+
+		id = subscribe(t, lp, "feed=feed1")
+		w = httptest.NewRecorder()
+		lp.AckHandler(w, httptest.NewRequest("GET", "/ack?eventID=1&subscriptionID="+id, nil))
+		if keys := responseKeys(t, w); keys != test.ack {
+			t.Errorf("Legacy %t: ack keys %s, expected %s", test.legacy, keys, test.ack)
+		}
+
+		w = httptest.NewRecorder()
+		lp.SubscribeAndListenHandler(w, httptest.NewRequest("GET", "/subscribeAndListen?feed=feed1&wait=false", nil))
+		if keys := responseKeys(t, w); keys != test.subscribeAndListen {
+			t.Errorf("Legacy %t: subscribe and listen keys %s, expected %s", test.legacy, keys, test.subscribeAndListen)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package longpoll
+
+// OnSubscribe sets a callback called when a client subscribes (or subscribes
+// again, replacing its feeds), with its feeds. Like the other lifecycle
+// callbacks (OnUnsubscribe, OnListenStart and OnListenEnd), it is called in
+// its own goroutine, so it never blocks the handlers and it can call the
+// LongPoll methods. A nil callback (the default) disables it.
+func (lp *LongPoll) OnSubscribe(callback func(subscriptionID string, feeds []string)) {
+	lp.mutex.Lock()
+	lp.onSubscribe = callback
+	lp.mutex.Unlock()
+}
+
+// OnUnsubscribe sets a callback called when a subscription is removed: the
+// client unsubscribed from all its feeds, or the subscription was closed,
+// expired or lost its last feed
+func (lp *LongPoll) OnUnsubscribe(callback func(subscriptionID string)) {
+	lp.mutex.Lock()
+	lp.onUnsubscribe = callback
+	lp.mutex.Unlock()
+}
+
+// OnListenStart sets a callback called when a listen request starts
+func (lp *LongPoll) OnListenStart(callback func(subscriptionID string)) {
+	lp.mutex.Lock()
+	lp.onListenStart = callback
+	lp.mutex.Unlock()
+}
+
+// OnListenEnd sets a callback called when a listen request ends, with the
+// reason: "DONE" (the events were sent), "ABORT" (a new request replaced it),
+// "TIMEOUT", "UNSUBSCRIBE", "DISCONNECT" (the client went away) or
+// "SHUTDOWN"
+func (lp *LongPoll) OnListenEnd(callback func(subscriptionID string, reason string)) {
+	lp.mutex.Lock()
+	lp.onListenEnd = callback
+	lp.mutex.Unlock()
+}
+
+// listenEnded calls the OnListenEnd callback, if any. It must be called
+// without holding the lock.
+func (lp *LongPoll) listenEnded(subscriptionID string, reason string) {
+	lp.mutex.RLock()
+	callback := lp.onListenEnd
+	lp.mutex.RUnlock()
+
+	if callback != nil {
+		go callback(subscriptionID, reason)
+	}
+}
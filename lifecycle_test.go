@@ -0,0 +1,37 @@
+package longpoll
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLifecycleCallbacks(t *testing.T) {
+	lp := New()
+	lp.SetLogger(nil)
+	lp.AddFeed("feed1")
+	lp.SetTimeout(30 * time.Millisecond)
+	calls := make(chan string, 10)
+	lp.OnSubscribe(func(subscriptionID string, feeds []string) { calls <- "subscribe " + subscriptionID })
+	lp.OnUnsubscribe(func(subscriptionID string) { calls <- "unsubscribe " + subscriptionID })
+	lp.OnListenStart(func(subscriptionID string) { calls <- "start " + subscriptionID })
+	lp.OnListenEnd(func(subscriptionID string, reason string) { calls <- "end " + subscriptionID + " " + reason })
+	expect := func(expected string) {
+		t.Helper()
+		select {
+		case call := <-calls:
+			if call != expected {
+				t.Fatalf("expected %q, got %q", expected, call)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expected %q, got no call", expected)
+		}
+	}
+
+	subscriptionID := subscribe(t, lp, "feed=feed1")
+	expect("subscribe " + subscriptionID)
+	listen(lp, "subscriptionID="+subscriptionID)
+	expect("start " + subscriptionID)
+	expect("end " + subscriptionID + " TIMEOUT")
+	lp.Unsubscribe(subscriptionID, nil)
+	expect("unsubscribe " + subscriptionID)
+}
@@ -1,11 +1,21 @@
 package longpoll
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"math/rand"
+	"net"
 	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/frncscsrcc/resthelper"
@@ -13,66 +23,514 @@ import (
 
 var seededRand = rand.New(rand.NewSource(time.Now().UnixNano()))
 
+// DefaultTimeout is the time a listen request waits for new events before
+// responding with a timeout
+const DefaultTimeout = 5 * time.Second
+
+// DefaultNotifyTimeout is how long a signal waits for the listen request to
+// receive it (see SetNotifyTimeout)
+const DefaultNotifyTimeout = time.Second
+
+// ErrNilData is returned when an event without data is published, and the nil
+// data are not allowed (see AllowNilData)
+var ErrNilData = errors.New("nil data")
+
+// ErrPayloadTooLarge is returned when the data of a published event exceeds
+// the size set with SetMaxPayloadSize
+var ErrPayloadTooLarge = errors.New("payload too large")
+
+// DefaultTokenLength is the length of the generated subscription IDs
+const DefaultTokenLength = 32
+
+// cleanupInterval is how often expired events are searched and deleted
+const cleanupInterval = time.Second
+
 type clientExist map[string]bool
 type feedToClients map[string]clientExist
-type event struct {
-	Data      interface{}
-	Feed      string
-	Timestamp int32
-}
-type events map[int]event
+type events map[int]Event
 type clientToNewEvents map[string][]int
 type clientToConnection map[string]int
 type connectionChannel map[int]chan string
 
+// Event is a generic object published on a feed. The ID is unique and
+// increasing, so it can be used as a cursor; the Timestamp is the creation
+// time, in milliseconds since the Unix epoch. If Recipient is not empty, the
+// event is delivered only to that client. An event published on more feeds at
+// once with NewEventToFeeds lists all of them in Feeds, and the first one in
+// Feed. An event sent to all the clients with Broadcast has no feed.
+// RequestID is the ID of the request that published the event with
+// PublishHandler, if any. Sequence is the number of the event for the client
+// that receives it: every subscription numbers its events from 1, without
+// gaps, so a missing number means that an event was lost (dropped from a full
+// queue, or expired before the delivery). In ack mode a resent event gets a
+// new number. ExpiresAt is the expiration time of an event published with
+// NewEventWithTTL, in milliseconds since the Unix epoch, or zero.
+type Event struct {
+	ID        int         `json:"id"`
+	Data      interface{} `json:"data"`
+	Feed      string      `json:"feed"`
+	Feeds     []string    `json:"feeds,omitempty"`
+	Timestamp int64       `json:"timestamp"`
+	RequestID string      `json:"requestID,omitempty"`
+	Sequence  int         `json:"sequence,omitempty"`
+	ExpiresAt int64       `json:"expiresAt,omitempty"`
+	Recipient string      `json:"-"`
+}
+
+// allFeeds returns the feeds the event was published on
+func (event Event) allFeeds() []string {
+	if len(event.Feeds) > 0 {
+		return event.Feeds
+	}
+	return []string{event.Feed}
+}
+
+// isBroadcast checks if the event was sent to all the clients with Broadcast
+func (event Event) isBroadcast() bool {
+	return event.Feed == "" && len(event.Feeds) == 0
+}
+
+// hasFeed checks if the event was published on a feed
+func (event Event) hasFeed(feed string) bool {
+	for _, eventFeed := range event.allFeeds() {
+		if eventFeed == feed {
+			return true
+		}
+	}
+	return false
+}
+
+// Logger is the interface used to log the activity of the package. It is
+// satisfied by *log.Logger and by most of the structured loggers.
+type Logger interface {
+	Printf(format string, args ...interface{})
+}
+
 type contextStructIdentifier int
 
 // ContextStructIdentifier identifies the key for the struct in the context
 // that contains sessionID, feeds and subscriptionID
 const (
 	ContextStructIdentifier contextStructIdentifier = iota
+	// bodyIdentifier identifies the key for the JSON body of the request,
+	// decoded by withBody
+	bodyIdentifier
 )
 
 // LongPoll is the exported basic package structure:
 type LongPoll struct {
+	mutex                    sync.RWMutex
 	globalClients            clientExist
-	globalEvents             events
+	eventStore               EventStore
 	globalClientToNewEvents  clientToNewEvents
+	globalClientToInFlight   clientToNewEvents
 	globalFeedToClients      feedToClients
+	globalPatternToClients   feedToClients
 	globalClientToConnection clientToConnection
 	globalConnectionChannel  connectionChannel
+	globalClientToActivity   map[string]time.Time
+	globalClientToLastListen map[string]time.Time
+	globalClientToFilter     map[string]EventFilter
+	globalClientToGroup      map[string]string
+	globalClientToName       map[string]string
+	globalClientToPaused     map[string]bool
+	globalClientToSequence   map[string]int
+	globalGroupToClients     feedToClients
+	groupCursors             map[string]int
 	globalLastConnection     int
+	publishedEvents          int
+	deliveredEvents          int
+	listenWaits              histogram
+	globalLastExpiredEvent   int
+	timeout                  time.Duration
+	notifyTimeout            time.Duration
+	initialDelay             time.Duration
+	flushOnAbort             bool
+	readyFrame               bool
+	feedTimeouts             map[string]time.Duration
+	feedAliases              map[string][]string
+	ackMode                  bool
+	maxConnections           int
+	maxEvents                int
+	minListenInterval        time.Duration
+	maxQueueLength           int
+	overflowPolicy           OverflowPolicy
+	overflowHandler          func(subscriptionID string, dropped int)
+	overflows                map[string]int
+	heartbeatInterval        time.Duration
+	compression              bool
+	legacyKeys               bool
+	dynamicFeeds             bool
+	autoRegister             bool
+	nilData                  bool
+	maxPayloadSize           int
+	eventTTL                 time.Duration
+	subscriptionTTL          time.Duration
+	cleanupStarted           bool
+	shutdown                 bool
+	done                     chan struct{}
+	connections              sync.WaitGroup
+	logger                   Logger
+	clock                    Clock
+	broker                   Broker
+	authorizer               Authorizer
+	trustedProxies           []*net.IPNet
+	serializers              map[string]Serializer
+	transformer              Transformer
+	onSubscribe              func(subscriptionID string, feeds []string)
+	onUnsubscribe            func(subscriptionID string)
+	onListenStart            func(subscriptionID string)
+	onListenEnd              func(subscriptionID string, reason string)
+	tokenLength              int
+	tokenGenerator           func() string
+	publishedIDs             map[string]time.Time
+	expiringEvents           map[int]int64
+	maxRetainedEvents        int
+	retainedEvents           []int
+	deduplicationTTL         time.Duration
+	subscriptionIDHeader     string
+	feedsHeader              string
 }
 
 // SubscriptionResponse is the standard response returned after a succesfull
 // subscription. It returns the ConnectionID and the list of subscribet tokens
 type SubscriptionResponse struct {
-	SubscriptionID string
-	Feeds          []string
+	SubscriptionID string   `json:"subscriptionId"`
+	Feeds          []string `json:"feeds"`
 }
 
 // EventResponse contains the field Events, that is a slice of all the events
-// that are passed to a listening subscriber.
+// that are passed to a listening subscriber, and LastEventID, the highest
+// event ID delivered so far: it can be passed back as lastEventID to replay
+// the following events after a reconnection. HasMore is true if the number of
+// events was limited and other events are still queued. Count is the number
+// of events, so the clients can validate the response. Events is never nil:
+// an empty list is encoded as [] (not null).
 type EventResponse struct {
-	Events []event
+	Events      []Event `json:"events"`
+	Count       int     `json:"count"`
+	LastEventID int     `json:"lastEventID"`
+	HasMore     bool    `json:"hasMore"`
+}
+
+// GroupedEventResponse is an EventResponse with the events grouped by feed,
+// returned to the clients that pass grouped=true. An event published on more
+// feeds is listed under its first feed, a broadcast under the empty feed.
+type GroupedEventResponse struct {
+	Events      map[string][]Event `json:"events"`
+	Count       int                `json:"count"`
+	LastEventID int                `json:"lastEventID"`
+	HasMore     bool               `json:"hasMore"`
+}
+
+// groupEvents groups by feed the events of an EventResponse
+func groupEvents(eventResponse EventResponse) GroupedEventResponse {
+	events := make(map[string][]Event)
+	for _, event := range eventResponse.Events {
+		events[event.Feed] = append(events[event.Feed], event)
+	}
+	return GroupedEventResponse{
+		Events:      events,
+		Count:       eventResponse.Count,
+		LastEventID: eventResponse.LastEventID,
+		HasMore:     eventResponse.HasMore,
+	}
 }
 
 // New is the constructor, it returns a pointer to a longpoll struct
 func New() *LongPoll {
 	lp := LongPoll{
 		globalClients:            make(clientExist),
-		globalEvents:             make(events),
+		eventStore:               NewMemoryStore(),
 		globalClientToNewEvents:  make(clientToNewEvents),
+		globalClientToInFlight:   make(clientToNewEvents),
 		globalFeedToClients:      make(map[string]clientExist),
+		globalPatternToClients:   make(feedToClients),
 		globalClientToConnection: make(clientToConnection),
 		globalConnectionChannel:  make(connectionChannel),
+		globalClientToActivity:   make(map[string]time.Time),
+		globalClientToLastListen: make(map[string]time.Time),
+		globalClientToFilter:     make(map[string]EventFilter),
+		globalClientToGroup:      make(map[string]string),
+		globalClientToName:       make(map[string]string),
+		globalClientToPaused:     make(map[string]bool),
+		globalClientToSequence:   make(map[string]int),
+		globalGroupToClients:     make(feedToClients),
+		groupCursors:             make(map[string]int),
+		overflows:                make(map[string]int),
+		timeout:                  DefaultTimeout,
+		notifyTimeout:            DefaultNotifyTimeout,
+		feedTimeouts:             make(map[string]time.Duration),
+		feedAliases:              make(map[string][]string),
+		done:                     make(chan struct{}),
+		logger:                   log.Default(),
+		clock:                    realClock{},
+		serializers:              make(map[string]Serializer),
+		tokenLength:              DefaultTokenLength,
+		nilData:                  true,
+		publishedIDs:             make(map[string]time.Time),
+		expiringEvents:           make(map[int]int64),
+		deduplicationTTL:         DefaultDeduplicationTTL,
+		subscriptionIDHeader:     SubscriptionIDHeader,
+		feedsHeader:              FeedsHeader,
 	}
 	return &lp
 }
 
+// SetLogger replaces the logger (by default the standard logger). A nil
+// logger disables logging. It should be called before serving requests.
+func (lp *LongPoll) SetLogger(logger Logger) {
+	if logger == nil {
+		logger = log.New(io.Discard, "", 0)
+	}
+	lp.mutex.Lock()
+	lp.logger = logger
+	lp.mutex.Unlock()
+}
+
+// SetTimeout sets how long a listen request waits for new events before
+// responding with a timeout. A listen request must always time out, so a
+// non positive duration is rejected.
+func (lp *LongPoll) SetTimeout(timeout time.Duration) error {
+	if timeout <= 0 {
+		return errors.New("timeout must be greater than zero")
+	}
+	lp.mutex.Lock()
+	lp.timeout = timeout
+	lp.mutex.Unlock()
+	return nil
+}
+
+// SetNotifyTimeout sets how long a signal (a new event, an unsubscription, the
+// shutdown...) waits for the listen request to receive it. The channel of a
+// request keeps one signal, so the send blocks only if another signal is
+// already waiting there (the request is terminating), and in this case the
+// signal is dropped after the timeout, instead of blocking the goroutine
+// forever. The events are not lost: they stay queued, and the next listen
+// request receives them.
+func (lp *LongPoll) SetNotifyTimeout(timeout time.Duration) error {
+	if timeout <= 0 {
+		return errors.New("notify timeout must be greater than zero")
+	}
+	lp.mutex.Lock()
+	lp.notifyTimeout = timeout
+	lp.mutex.Unlock()
+	return nil
+}
+
+// SetInitialDelay sets how long a listen request waits for the first event
+// before responding with an empty list (200), instead of waiting until the
+// timeout: the clients poll more often, but they are never held for long. It
+// applies only if it is shorter than the timeout of the request, otherwise
+// the request responds with 408 at the timeout as usual. Zero (the default)
+// disables it.
+func (lp *LongPoll) SetInitialDelay(delay time.Duration) error {
+	if delay < 0 {
+		return errors.New("initial delay must not be negative")
+	}
+	lp.mutex.Lock()
+	lp.initialDelay = delay
+	lp.mutex.Unlock()
+	return nil
+}
+
+// FlushOnAbort enables (or disables) the delivery of the queued events by an
+// aborted listen request: when a new request for the same subscription
+// arrives, the pending one responds with 200 and the events already queued,
+// instead of 204, and the new one waits for the following events (unless it
+// passes wait=false: the events are then delivered by the first of the two
+// requests that takes them). It is disabled by default.
+func (lp *LongPoll) FlushOnAbort(flush bool) {
+	lp.mutex.Lock()
+	lp.flushOnAbort = flush
+	lp.mutex.Unlock()
+}
+
+// SendReadyFrame enables (or disables) the ready frame: the streaming
+// transports (SSE, NDJSON and WebSocket) send it as soon as the stream is
+// open, before any event, so the clients can tell a connected but idle
+// stream from one still connecting (see Stream.Ready). It is disabled by
+// default.
+func (lp *LongPoll) SendReadyFrame(send bool) {
+	lp.mutex.Lock()
+	lp.readyFrame = send
+	lp.mutex.Unlock()
+}
+
+// SetFeedTimeout overrides the listen timeout for the clients subscribed to
+// a feed. When a client is subscribed to more feeds, its listen requests wait
+// for the shortest timeout among the feeds with an override; the timeout set
+// with SetTimeout applies only if none of its feeds has one. A zero duration
+// removes the override.
+func (lp *LongPoll) SetFeedTimeout(feed string, timeout time.Duration) error {
+	if timeout < 0 {
+		return errors.New("timeout must not be negative")
+	}
+	lp.mutex.Lock()
+	defer lp.mutex.Unlock()
+
+	if _, exists := lp.globalFeedToClients[feed]; exists == false {
+		return errors.New("feed " + feed + " does not exist")
+	}
+	if timeout == 0 {
+		delete(lp.feedTimeouts, feed)
+	} else {
+		lp.feedTimeouts[feed] = timeout
+	}
+	return nil
+}
+
+// SetMaxConnections limits the number of open listen connections: when the
+// limit is reached, the new ones are rejected with 503. A new connection that
+// replaces the previous one of the same client is always accepted. Zero (the
+// default) means no limit.
+func (lp *LongPoll) SetMaxConnections(maxConnections int) error {
+	if maxConnections < 0 {
+		return errors.New("max connections must not be negative")
+	}
+	lp.mutex.Lock()
+	lp.maxConnections = maxConnections
+	lp.mutex.Unlock()
+	return nil
+}
+
+// SetMaxEvents limits the number of events returned by a listen request: the
+// other events stay queued, and the response reports that more events are
+// available. A client can ask for fewer events with the limit parameter in
+// the query-string, but not for more. Zero (the default) means no limit.
+func (lp *LongPoll) SetMaxEvents(maxEvents int) error {
+	if maxEvents < 0 {
+		return errors.New("max events must not be negative")
+	}
+	lp.mutex.Lock()
+	lp.maxEvents = maxEvents
+	lp.mutex.Unlock()
+	return nil
+}
+
+// SetMinListenInterval sets the minimum interval between the starts of two
+// listen requests of the same client: a client polling faster is rejected
+// with 429. Zero (the default) means no limit.
+func (lp *LongPoll) SetMinListenInterval(interval time.Duration) error {
+	if interval < 0 {
+		return errors.New("min listen interval must not be negative")
+	}
+	lp.mutex.Lock()
+	lp.minListenInterval = interval
+	lp.mutex.Unlock()
+	return nil
+}
+
+// SetTokenLength sets the length of the random subscription IDs generated for
+// the clients that do not pass one (DefaultTokenLength by default).
+func (lp *LongPoll) SetTokenLength(length int) error {
+	if length <= 0 {
+		return errors.New("token length must be greater than zero")
+	}
+	lp.mutex.Lock()
+	lp.tokenLength = length
+	lp.mutex.Unlock()
+	return nil
+}
+
+// SetTokenGenerator replaces the random subscription IDs with the ones
+// returned by generator (for example UUIDs, or signed tokens). The generated
+// IDs must be unique. A nil generator restores the random IDs.
+func (lp *LongPoll) SetTokenGenerator(generator func() string) {
+	lp.mutex.Lock()
+	lp.tokenGenerator = generator
+	lp.mutex.Unlock()
+}
+
+// newSubscriptionID generates the ID of a new subscription
+func (lp *LongPoll) newSubscriptionID() string {
+	lp.mutex.RLock()
+	generator := lp.tokenGenerator
+	length := lp.tokenLength
+	lp.mutex.RUnlock()
+
+	if generator != nil {
+		return generator()
+	}
+	return resthelper.GetNewToken(length)
+}
+
+// SetHeartbeatInterval enables the heartbeats: while a listen request waits,
+// a whitespace is sent every interval, and a comment is sent on the idle SSE
+// streams. This prevents the proxies from closing the idle connections, but
+// for a listen request the status code is sent with the first heartbeat, so
+// the requests waiting longer than the interval always respond with 200 (the
+// body still reports the errors, like the timeout). Zero (the default) means
+// no heartbeats.
+func (lp *LongPoll) SetHeartbeatInterval(interval time.Duration) error {
+	if interval < 0 {
+		return errors.New("heartbeat interval must not be negative")
+	}
+	lp.mutex.Lock()
+	lp.heartbeatInterval = interval
+	lp.mutex.Unlock()
+	return nil
+}
+
+// SetEventStore replaces the store used to persist the events (by default a
+// MemoryStore). It should be called before publishing any event.
+func (lp *LongPoll) SetEventStore(eventStore EventStore) {
+	lp.mutex.Lock()
+	lp.eventStore = eventStore
+	lp.mutex.Unlock()
+}
+
+// SetEventTTL sets how long an event is retained. Expired events are
+// periodically deleted, even if some client did not receive them yet. A zero
+// duration (the default) means that events are retained forever.
+func (lp *LongPoll) SetEventTTL(ttl time.Duration) error {
+	if ttl < 0 {
+		return errors.New("event TTL must not be negative")
+	}
+	lp.mutex.Lock()
+	defer lp.mutex.Unlock()
+
+	lp.eventTTL = ttl
+	if ttl > 0 {
+		lp.startCleanup()
+	}
+	return nil
+}
+
+// SetSubscriptionTTL sets how long a subscription is retained without any
+// activity (subscribe or listen request). Idle subscriptions are periodically
+// deleted, and their next listen request responds with 401. A client with an
+// open connection is never idle. A zero duration (the default) means that
+// subscriptions are retained forever.
+func (lp *LongPoll) SetSubscriptionTTL(ttl time.Duration) error {
+	if ttl < 0 {
+		return errors.New("subscription TTL must not be negative")
+	}
+	lp.mutex.Lock()
+	defer lp.mutex.Unlock()
+
+	lp.subscriptionTTL = ttl
+	if ttl > 0 {
+		lp.startCleanup()
+	}
+	return nil
+}
+
+// startCleanup starts the cleanup goroutine, if it is not running yet. It
+// must be called holding the lock.
+func (lp *LongPoll) startCleanup() {
+	if lp.cleanupStarted == false {
+		lp.cleanupStarted = true
+		go lp.cleanupLoop()
+	}
+}
+
 // AddFeed registers one feed. A client can subscribe and listen only
-// to existing feeds.
+// to existing feeds, unless AllowDynamicFeeds is used.
 func (lp *LongPoll) AddFeed(feed string) error {
+	lp.mutex.Lock()
+	defer lp.mutex.Unlock()
+
 	// Do not do anything if feed exists
 	if _, exists := lp.globalFeedToClients[feed]; exists == true {
 		return errors.New("feed " + feed + " already exists")
@@ -94,164 +552,1512 @@ func (lp *LongPoll) AddFeeds(feeds []string) error {
 	return nil
 }
 
+// ListFeeds returns the sorted list of the registered feeds
+func (lp *LongPoll) ListFeeds() []string {
+	lp.mutex.RLock()
+	defer lp.mutex.RUnlock()
+
+	feeds := make([]string, 0, len(lp.globalFeedToClients))
+	for feed := range lp.globalFeedToClients {
+		feeds = append(feeds, feed)
+	}
+	sort.Strings(feeds)
+	return feeds
+}
+
+// RemoveFeed deletes one feed and its events. The events published also on
+// other feeds (with NewEventToFeeds) are kept for them, and the feed is
+// removed from their feeds if the EventStore is an EventUpdater. The clients
+// that were subscribed only to this feed are unsubscribed: a pending listen
+// request responds with 410 and the next one with 401.
+func (lp *LongPoll) RemoveFeed(feed string) error {
+	lp.mutex.Lock()
+
+	clients, exists := lp.globalFeedToClients[feed]
+	if exists == false {
+		lp.mutex.Unlock()
+		return errors.New("feed " + feed + " does not exist")
+	}
+	delete(lp.globalFeedToClients, feed)
+	delete(lp.feedTimeouts, feed)
+
+	lp.removeFeedEvents(feed)
+
+	pendingChannels := make([]chan string, 0)
+	for client := range clients {
+		if len(lp.clientFeeds(client)) > 0 {
+			continue
+		}
+		if comunicationChannel := lp.removeClient(client); comunicationChannel != nil {
+			pendingChannels = append(pendingChannels, comunicationChannel)
+		}
+	}
+	lp.mutex.Unlock()
+
+	for _, comunicationChannel := range pendingChannels {
+		go lp.notify(comunicationChannel, "UNSUBSCRIBE")
+	}
+	return nil
+}
+
+// removeFeedEvents deletes the events of a removed feed, except the ones
+// published also on other feeds: those lose the removed feed, and they are
+// removed only from the queues of the clients that do not receive them from
+// another feed (the queued ones skip their Sequence numbers, as in
+// deleteEvents). It must be called holding the lock, after the feed was
+// removed.
+func (lp *LongPoll) removeFeedEvents(feed string) {
+	deleted := make(map[int]bool)
+	kept := make(map[int]Event)
+	for _, event := range lp.eventStore.LoadSince(feed, 0) {
+		remaining := make([]string, 0)
+		for _, eventFeed := range event.allFeeds() {
+			if eventFeed != feed {
+				remaining = append(remaining, eventFeed)
+			}
+		}
+		if len(remaining) == 0 {
+			deleted[event.ID] = true
+			continue
+		}
+
+		event.Feed, event.Feeds = remaining[0], nil
+		if len(remaining) > 1 {
+			event.Feeds = remaining
+		}
+		if eventUpdater, ok := lp.eventStore.(EventUpdater); ok == true {
+			eventUpdater.Update(event)
+		}
+		kept[event.ID] = event
+	}
+	lp.deleteEvents(deleted)
+	if len(kept) == 0 {
+		return
+	}
+
+	for client, queue := range lp.globalClientToNewEvents {
+		pending := lp.removeUnreceivedEvents(client, queue, kept)
+		lp.globalClientToSequence[client] = lp.globalClientToSequence[client] + len(queue) - len(pending)
+		lp.globalClientToNewEvents[client] = pending
+	}
+	for client, queue := range lp.globalClientToInFlight {
+		lp.globalClientToInFlight[client] = lp.removeUnreceivedEvents(client, queue, kept)
+	}
+}
+
+// removeUnreceivedEvents returns a copy of the queue of a client without the
+// passed events it does not receive anymore. It must be called holding the
+// lock.
+func (lp *LongPoll) removeUnreceivedEvents(subscriptionID string, queue []int, events map[int]Event) []int {
+	pending := make([]int, 0, len(queue))
+	for _, eventID := range queue {
+		if event, exists := events[eventID]; exists == false || lp.receivesEvent(subscriptionID, event) == true {
+			pending = append(pending, eventID)
+		}
+	}
+	return pending
+}
+
+// AllowDynamicFeeds enables (or disables) the dynamic feeds: the unknown
+// feeds are registered when a client subscribes to them, or when an event is
+// published on them, instead of being rejected. By default only the feeds
+// registered with AddFeed are available, so a typo in a feed name does not
+// create a new feed.
+func (lp *LongPoll) AllowDynamicFeeds(allow bool) {
+	lp.mutex.Lock()
+	lp.dynamicFeeds = allow
+	lp.mutex.Unlock()
+}
+
+// AllowNilData allows (or rejects) the events without data, for example
+// NewEvent(feed, nil). They are allowed by default, and they are delivered
+// with a null data, that can confuse the clients expecting an object: when
+// they are rejected, publishing them returns ErrNilData (and PublishHandler
+// responds with 400).
+func (lp *LongPoll) AllowNilData(allow bool) {
+	lp.mutex.Lock()
+	lp.nilData = allow
+	lp.mutex.Unlock()
+}
+
+// SetMaxPayloadSize limits the size, in bytes, of the data of the published
+// events, measured after the JSON encoding: publishing a larger event returns
+// ErrPayloadTooLarge (and PublishHandler responds with 413). Zero (the
+// default) means no limit.
+func (lp *LongPoll) SetMaxPayloadSize(size int) error {
+	if size < 0 {
+		return errors.New("max payload size must not be negative")
+	}
+	lp.mutex.Lock()
+	lp.maxPayloadSize = size
+	lp.mutex.Unlock()
+	return nil
+}
+
+// checkData returns ErrNilData if the data is nil and the nil data are not
+// allowed, or ErrPayloadTooLarge if the encoded data exceeds the max payload
+// size. The data is encoded once per event, and not at all if it is already
+// encoded as JSON (see RawData). It must be called holding the lock.
+func (lp *LongPoll) checkData(data interface{}) error {
+	if lp.nilData == false && isNil(data) {
+		return ErrNilData
+	}
+	if lp.maxPayloadSize == 0 {
+		return nil
+	}
+	if raw, ok := data.(RawData); ok == true && isJSONContentType(raw.ContentType) {
+		if len(raw.Body) > lp.maxPayloadSize {
+			return ErrPayloadTooLarge
+		}
+		return nil
+	}
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	if len(encoded) > lp.maxPayloadSize {
+		return ErrPayloadTooLarge
+	}
+	return nil
+}
+
+// isNil checks if the data is nil, or a nil pointer, map or slice
+func isNil(data interface{}) bool {
+	if data == nil {
+		return true
+	}
+	switch value := reflect.ValueOf(data); value.Kind() {
+	case reflect.Ptr, reflect.Map, reflect.Slice, reflect.Interface:
+		return value.IsNil()
+	}
+	return false
+}
+
+// feedAvailable checks if a client can subscribe, or an event can be
+// published, on a feed: it must exist, unless the dynamic feeds are enabled.
+// It must be called holding the lock.
+func (lp *LongPoll) feedAvailable(feed string) bool {
+	if _, exists := lp.globalFeedToClients[feed]; exists == true {
+		return true
+	}
+	return lp.dynamicFeeds == true && len(feed) > 0
+}
+
+// ensureFeed registers a feed, if it does not exist. It must be called
+// holding the lock.
+func (lp *LongPoll) ensureFeed(feed string) {
+	if _, exists := lp.globalFeedToClients[feed]; exists == false {
+		lp.globalFeedToClients[feed] = make(clientExist)
+	}
+}
+
 // SubscribeHandler handles the subscription client request. It expects one or
-// more feeds in the query-string and, in case of success, it returns an object
-// of type SubscriptionResponse
+// more feeds in the query-string (or in a JSON body like {"feeds": [...]}) and,
+// in case of success, it returns an object of type SubscriptionResponse. If
+// one of the feeds is not available, it responds with 409 and the client is
+// not subscribed to any of them.
+// With backlog=N in the query-string, the last N events already published on
+// the feeds are queued, so the first listen request returns them immediately;
+// the events older than the TTL set with SetEventTTL are not available.
+// A client that subscribes again with its subscriptionID replaces its feeds:
+// it is removed from the feeds that are not in the new list, and the queued
+// events of those feeds are discarded, unless keepEvents=true is passed in
+// the query-string.
+// A feed ending with "*" is a pattern: the client receives the events of all
+// the feeds starting with the same prefix, even if they are added later.
+// A feed registered with AddFeedAlias is replaced by its targets.
+// The clients that pass the same group=NAME in the query-string form a
+// consumer group: every event is delivered to only one of them.
+// The client can pass a display name with name=NAME in the query-string: it
+// is listed by Presence.
 func (lp *LongPoll) SubscribeHandler(w http.ResponseWriter, r *http.Request) {
-	feeds := getFeeds(r)
-	if len(feeds) == 0 {
-		resthelper.SendError(w, 400, "Missing feed")
+	r = withBody(r)
+	subscriptionID, feeds, ok := lp.subscribe(w, r)
+	if ok == false {
 		return
 	}
-	// If a subscriptionID is present, use subscriptionID ID as user token,
-	// otherwhise create a new one
-	subscriptionID := getSubscriptionID(r)
+	lp.sendResponse(w, r, SubscriptionResponse{subscriptionID, feeds})
+}
+
+// subscribe subscribes the client of the request to the feeds, as described
+// in SubscribeHandler. If the subscription fails, it sends the error response
+// and returns false.
+func (lp *LongPoll) subscribe(w http.ResponseWriter, r *http.Request) (string, []string, bool) {
+	getRequestID(w, r)
+
+	feeds := lp.resolveAliases(uniqueFeeds(lp.getFeeds(r)))
+	if len(feeds) == 0 {
+		sendError(w, 400, ErrorMissingFeed, "Missing feed")
+		return "", nil, false
+	}
+
+	authorizedID, err := lp.authorizeSubscription(r, feeds)
+	if err != nil {
+		sendAuthError(w, err)
+		return "", nil, false
+	}
+
+	// If the authorizer or the client passed a subscriptionID, use it as user
+	// token, otherwhise create a new one
+	subscriptionID := authorizedID
+	if subscriptionID == "" {
+		subscriptionID = lp.getSubscriptionID(r)
+	}
 	if subscriptionID == "" {
-		subscriptionID = resthelper.GetNewToken(32)
+		subscriptionID = lp.newSubscriptionID()
 	}
 
-	// Client is not pending
-	lp.globalClients[subscriptionID] = false
+	lp.mutex.Lock()
+
+	if lp.shutdown == true {
+		lp.mutex.Unlock()
+		sendError(w, 503, ErrorServiceUnavailable, "Service unavailable")
+		return "", nil, false
+	}
 
-	// Feeds validation
+	// Feeds validation. The lock is held until the client is subscribed, so a
+	// feed can not be removed in the meantime.
 	for _, feed := range feeds {
-		if _, ok := lp.globalFeedToClients[feed]; ok == false {
-			resthelper.SendError(w, 500, fmt.Sprintf("Feed %s is not available", feed))
-			return
+		if isPattern(feed) {
+			if isValidPattern(feed) == false {
+				lp.mutex.Unlock()
+				sendError(w, 400, ErrorInvalidFeedPattern, fmt.Sprintf("Feed pattern %s is not valid", feed))
+				return "", nil, false
+			}
+			continue
+		}
+		if lp.feedAvailable(feed) == false {
+			lp.mutex.Unlock()
+			sendError(w, 409, ErrorFeedNotAvailable, fmt.Sprintf("Feed %s is not available", feed))
+			return "", nil, false
+		}
+	}
+
+	// A client that subscribes again replaces its feeds
+	_, resubscribe := lp.globalClients[subscriptionID]
+	if resubscribe == true {
+		lp.removeClientFeeds(subscriptionID, feeds)
+	}
+	lp.addClient(subscriptionID, feeds)
+	lp.setClientGroup(subscriptionID, getGroup(r))
+	lp.setClientName(subscriptionID, getName(r))
+	if resubscribe == true && getKeepEvents(r) == false {
+		lp.dropUnwantedEvents(subscriptionID)
+	}
+	if backlog, ok := getBacklog(r); ok == true {
+		lp.queueBacklog(subscriptionID, backlog)
+	}
+
+	lp.mutex.Unlock()
+
+	return subscriptionID, feeds, true
+}
+
+// removeClientFeeds removes a client from its feeds (and patterns) that are
+// not included in feeds. It must be called holding the lock.
+func (lp *LongPoll) removeClientFeeds(subscriptionID string, feeds []string) {
+	keep := make(map[string]bool)
+	for _, feed := range feeds {
+		keep[feed] = true
+	}
+	for _, feed := range lp.clientFeeds(subscriptionID) {
+		if keep[feed] == false {
+			delete(lp.globalFeedToClients[feed], subscriptionID)
+			lp.deletePatternClient(feed, subscriptionID)
+		}
+	}
+}
+
+// dropUnwantedEvents removes from the queue of a client the events of the
+// feeds it is not subscribed to anymore. It must be called holding the lock.
+func (lp *LongPoll) dropUnwantedEvents(subscriptionID string) {
+	queue := make([]int, 0)
+	for _, eventID := range lp.globalClientToNewEvents[subscriptionID] {
+		event, exists := lp.eventStore.Load(eventID)
+		if exists == true && (event.Recipient == subscriptionID || lp.receivesEvent(subscriptionID, event)) {
+			queue = append(queue, eventID)
 		}
 	}
+	if len(queue) == 0 {
+		delete(lp.globalClientToNewEvents, subscriptionID)
+		return
+	}
+	lp.globalClientToNewEvents[subscriptionID] = queue
+}
+
+// addClient subscribes a client to the feeds (and to the patterns), that must
+// be already validated. It must be called holding the lock.
+func (lp *LongPoll) addClient(subscriptionID string, feeds []string) {
+	// Client is not pending (do not reset a client that is already listening)
+	if _, exists := lp.globalClients[subscriptionID]; exists == false {
+		lp.globalClients[subscriptionID] = false
+	}
+	lp.globalClientToActivity[subscriptionID] = lp.clock.Now()
 
 	// Client subscription
 	for _, feed := range feeds {
+		if isPattern(feed) {
+			if _, exists := lp.globalPatternToClients[feed]; exists == false {
+				lp.globalPatternToClients[feed] = make(clientExist)
+			}
+			lp.globalPatternToClients[feed][subscriptionID] = true
+			continue
+		}
+		lp.ensureFeed(feed)
 		lp.globalFeedToClients[feed][subscriptionID] = true
 	}
 
-	resthelper.SendResponse(w, SubscriptionResponse{subscriptionID, feeds})
+	if lp.onSubscribe != nil {
+		go lp.onSubscribe(subscriptionID, feeds)
+	}
+}
+
+// uniqueFeeds removes the duplicated feeds, keeping the order
+func uniqueFeeds(feeds []string) []string {
+	unique := make([]string, 0, len(feeds))
+	seen := make(map[string]bool)
+	for _, feed := range feeds {
+		if seen[feed] == false {
+			seen[feed] = true
+			unique = append(unique, feed)
+		}
+	}
+	return unique
+}
+
+// Unsubscribe removes a client from the passed feeds. If no feed is passed,
+// the client is removed from all its feeds. A client that is not subscribed
+// to any feed anymore is forgotten, and its pending listen request (if any)
+// is released.
+func (lp *LongPoll) Unsubscribe(subscriptionID string, feeds []string) error {
+	lp.mutex.Lock()
+
+	if _, clientExists := lp.globalClients[subscriptionID]; clientExists == false {
+		lp.mutex.Unlock()
+		return errors.New("subscription " + subscriptionID + " does not exist")
+	}
+
+	if len(feeds) == 0 {
+		feeds = lp.clientFeeds(subscriptionID)
+	}
+	for _, feed := range feeds {
+		delete(lp.globalFeedToClients[feed], subscriptionID)
+		lp.deletePatternClient(feed, subscriptionID)
+	}
+
+	// The client still listens to some feeds
+	if len(lp.clientFeeds(subscriptionID)) > 0 {
+		lp.mutex.Unlock()
+		return nil
+	}
+
+	comunicationChannel := lp.removeClient(subscriptionID)
+	lp.mutex.Unlock()
+
+	if comunicationChannel != nil {
+		go lp.notify(comunicationChannel, "UNSUBSCRIBE")
+	}
+	return nil
+}
+
+// CloseSubscription forcibly removes a subscription, with all its feeds and
+// its queued events: it is meant for the administrators, for example to
+// disconnect a misbehaving client. A pending listen request is released as if
+// the client unsubscribed, and the following ones respond with 401. It returns
+// an error if the subscription does not exist.
+func (lp *LongPoll) CloseSubscription(subscriptionID string) error {
+	lp.mutex.Lock()
+	if _, clientExists := lp.globalClients[subscriptionID]; clientExists == false {
+		lp.mutex.Unlock()
+		return errors.New("subscription " + subscriptionID + " does not exist")
+	}
+	comunicationChannel := lp.removeClient(subscriptionID)
+	lp.mutex.Unlock()
+
+	lp.logger.Printf("Subscription %s closed\n", subscriptionID)
+	if comunicationChannel != nil {
+		go lp.notify(comunicationChannel, "UNSUBSCRIBE")
+	}
+	return nil
+}
+
+// UnsubscribeHandler handles the unsubscription client request. It expects a
+// subscriptionID and optionally the feeds to leave in the query-string (no
+// feed means all the feeds). In case of success it returns an object of type
+// SubscriptionResponse with the feeds the client is still subscribed to.
+func (lp *LongPoll) UnsubscribeHandler(w http.ResponseWriter, r *http.Request) {
+	getRequestID(w, r)
+	r = withBody(r)
+
+	subscriptionID := lp.getSubscriptionID(r)
+	if subscriptionID == "" {
+		sendError(w, 400, ErrorMissingSubscriptionID, "Missing subscriptionID")
+		return
+	}
+
+	if err := lp.Unsubscribe(subscriptionID, lp.getFeeds(r)); err != nil {
+		sendError(w, 401, ErrorUnknownSubscription, "Unauthorized")
+		return
+	}
+
+	lp.mutex.RLock()
+	feeds := lp.clientFeeds(subscriptionID)
+	lp.mutex.RUnlock()
+
+	lp.sendResponse(w, r, SubscriptionResponse{subscriptionID, feeds})
+}
+
+// clientFeeds returns the sorted list of the feeds (and of the patterns) a
+// client is subscribed to. It must be called holding the lock.
+func (lp *LongPoll) clientFeeds(subscriptionID string) []string {
+	feeds := make([]string, 0)
+	for _, feedClients := range []feedToClients{lp.globalFeedToClients, lp.globalPatternToClients} {
+		for feed, clients := range feedClients {
+			if clients[subscriptionID] == true {
+				feeds = append(feeds, feed)
+			}
+		}
+	}
+	sort.Strings(feeds)
+	return feeds
+}
+
+// deletePatternClient removes a client from a pattern, forgetting the
+// patterns without clients. It must be called holding the lock.
+func (lp *LongPoll) deletePatternClient(pattern string, subscriptionID string) {
+	if clients, exists := lp.globalPatternToClients[pattern]; exists == true {
+		delete(clients, subscriptionID)
+		if len(clients) == 0 {
+			delete(lp.globalPatternToClients, pattern)
+		}
+	}
+}
+
+// clientTimeout returns the listen timeout for a client: the shortest among
+// the timeouts of its feeds, or the default one. It must be called holding the
+// lock.
+func (lp *LongPoll) clientTimeout(subscriptionID string) time.Duration {
+	var timeout time.Duration
+	for _, feed := range lp.clientFeeds(subscriptionID) {
+		if feedTimeout, ok := lp.feedTimeouts[feed]; ok == true && (timeout == 0 || feedTimeout < timeout) {
+			timeout = feedTimeout
+		}
+	}
+	if timeout == 0 {
+		return lp.timeout
+	}
+	return timeout
+}
+
+// removeClient forgets a client and its queued events. If the client has a
+// pending listen request, it returns the channel that should be used to
+// release it (once the lock is released), otherwise nil. It must be called
+// holding the lock.
+func (lp *LongPoll) removeClient(subscriptionID string) chan string {
+	var comunicationChannel chan string
+	if lp.globalClients[subscriptionID] == true {
+		comunicationChannel = lp.globalConnectionChannel[lp.globalClientToConnection[subscriptionID]]
+	}
+	for _, clients := range lp.globalFeedToClients {
+		delete(clients, subscriptionID)
+	}
+	for pattern := range lp.globalPatternToClients {
+		lp.deletePatternClient(pattern, subscriptionID)
+	}
+	delete(lp.globalClients, subscriptionID)
+	delete(lp.globalClientToNewEvents, subscriptionID)
+	delete(lp.globalClientToInFlight, subscriptionID)
+	delete(lp.globalClientToConnection, subscriptionID)
+	delete(lp.globalClientToActivity, subscriptionID)
+	delete(lp.globalClientToLastListen, subscriptionID)
+	delete(lp.globalClientToFilter, subscriptionID)
+	delete(lp.globalClientToPaused, subscriptionID)
+	delete(lp.globalClientToSequence, subscriptionID)
+	delete(lp.globalClientToName, subscriptionID)
+	lp.setClientGroup(subscriptionID, "")
+	if lp.onUnsubscribe != nil {
+		go lp.onUnsubscribe(subscriptionID)
+	}
+	return comunicationChannel
+}
+
+// queueBacklog queues for a client the last events published on its feeds,
+// at most backlog, keeping the queue sorted and without duplicates. Only the
+// events that did not expire are available. It must be called holding the
+// lock.
+func (lp *LongPoll) queueBacklog(subscriptionID string, backlog int) {
+	recent := make([]int, 0)
+	for _, event := range lp.eventStore.LoadSince("", 0) {
+		if event.Recipient == "" && lp.receivesEvent(subscriptionID, event) {
+			recent = append(recent, event.ID)
+		}
+	}
+	if len(recent) > backlog {
+		recent = recent[len(recent)-backlog:]
+	}
+
+	queued := make(map[int]bool)
+	for _, eventID := range append(lp.globalClientToNewEvents[subscriptionID], recent...) {
+		queued[eventID] = true
+	}
+	queue := make([]int, 0, len(queued))
+	for eventID := range queued {
+		queue = append(queue, eventID)
+	}
+	sort.Ints(queue)
+	lp.globalClientToNewEvents[subscriptionID] = queue
+}
+
+// replayEvents queues again all the events following lastEventID that the
+// client could receive, keeping the queue sorted and without duplicates. It
+// must be called holding the lock.
+func (lp *LongPoll) replayEvents(subscriptionID string, lastEventID int) {
+	queued := make(map[int]bool)
+	for _, eventID := range lp.globalClientToNewEvents[subscriptionID] {
+		queued[eventID] = true
+	}
+	for _, event := range lp.eventStore.LoadSince("", lastEventID) {
+		if event.Recipient == subscriptionID || (event.Recipient == "" && lp.receivesEvent(subscriptionID, event)) {
+			queued[event.ID] = true
+		}
+	}
+	queue := make([]int, 0, len(queued))
+	for eventID := range queued {
+		queue = append(queue, eventID)
+	}
+	sort.Ints(queue)
+	lp.globalClientToNewEvents[subscriptionID] = queue
 }
 
 // ListenHandler handles the listening requests from a client.
 // It cloud respond with:
-// - 400: Missing or invalid SubscriptionID
-// - 401: Does not exists a valid subscription for the passed subscriptionID.
-// - 200: EventResponse type: the list of events triggered since the last time
-//        an EventResponse was sent for this subscriptionID
-// - 204: ConnectionAborted: a new request come with the same SubscriptionID
-//        before the current one was resolved (or went timeout)
-// - 408: Request timeout: the client should implement a new request on the same
-//        endpoint.
+//   - 400: Missing or invalid SubscriptionID
+//   - 401: Does not exists a valid subscription for the passed subscriptionID
+//     (unless AllowAutoRegister is enabled and the request passes the feeds).
+//   - 200: EventResponse type: the list of events triggered since the last time
+//     an EventResponse was sent for this subscriptionID. If wait=false is
+//     passed in the query-string, the response is sent immediately, even if
+//     the list is empty; the list is empty also if no event arrives within
+//     the delay set with SetInitialDelay.
+//     At most limit events are returned, if it is passed in the query-string
+//     or set with SetMaxEvents: hasMore reports that other events are queued.
+//     With grouped=true, a GroupedEventResponse is returned instead, with the
+//     events grouped by feed.
+//   - 204: ConnectionAborted: a new request come with the same SubscriptionID
+//     before the current one was resolved (or went timeout). The aborted
+//     request does not take any event: the new one receives all of them,
+//     unless FlushOnAbort is enabled.
+//   - 408: Request timeout: the client should implement a new request on the same
+//     endpoint (Retry-After is 0).
+//   - 409: No feeds: the subscription is not subscribed to any feed, and it
+//     has no event to deliver, so it would wait in vain.
+//   - 410: Subscription removed: the client unsubscribed while the request was
+//     pending, or Events not available: some of the events following the
+//     lastEventID passed in the query-string already expired.
+//   - 429: Too many requests: the client started the previous request less
+//     than the interval set with SetMinListenInterval ago. Retry-After
+//     reports how many seconds the client should wait.
+//   - 503: Service unavailable: the server is shutting down, or Too many
+//     connections: the limit set with SetMaxConnections was reached.
 func (lp *LongPoll) ListenHandler(w http.ResponseWriter, r *http.Request) {
-	subscriptionID := getSubscriptionID(r)
+	getRequestID(w, r)
+	r = withBody(r)
+
+	subscriptionID := lp.getSubscriptionID(r)
 	if subscriptionID == "" {
-		resthelper.SendError(w, 400, "Missing subscriptionID")
+		sendError(w, 400, ErrorMissingSubscriptionID, "Missing subscriptionID")
+		return
+	}
+
+	if err := lp.authorizeListen(r, subscriptionID); err != nil {
+		sendAuthError(w, err)
+		return
+	}
+
+	subscriptionID, ok := lp.registerOnListen(w, r, subscriptionID)
+	if ok == false {
 		return
 	}
 
+	grouped := getGrouped(r)
+	lp.listen(w, r, subscriptionID, func(eventResponse EventResponse) interface{} {
+		if grouped == true {
+			return groupEvents(eventResponse)
+		}
+		return eventResponse
+	})
+}
+
+// listen waits for the events of a subscription, as described in
+// ListenHandler, and sends them in the response built by wrap
+func (lp *LongPoll) listen(w http.ResponseWriter, r *http.Request, subscriptionID string, wrap func(EventResponse) interface{}) {
+	requestID := getRequestID(w, r)
+
+	lp.mutex.Lock()
+
 	// Check if subscriptionID exists
 	if _, clientExists := lp.globalClients[subscriptionID]; clientExists == false {
-		resthelper.SendError(w, 401, "Unauthorized")
+		lp.mutex.Unlock()
+		sendError(w, 401, ErrorUnknownSubscription, "Unauthorized")
 		return
 	}
 
-	log.Printf("Received request from %s\n", subscriptionID)
+	if lp.shutdown == true {
+		lp.mutex.Unlock()
+		sendError(w, 503, ErrorServiceUnavailable, "Service unavailable")
+		return
+	}
 
-	// Protect with mutex
-	lp.globalLastConnection = lp.globalLastConnection + 1
-	currentConnection := lp.globalLastConnection
-	// Check if there is a previous listen connection, in this case
-	if previousConnectionIndex, ok := lp.globalClientToConnection[subscriptionID]; ok == true {
-		// Send a ABORT signal to previous connection
-		log.Printf("Closing previous connection (%d) from the same client (%s)\n", previousConnectionIndex, subscriptionID)
-		log.Printf("%+v\n", lp.globalConnectionChannel[previousConnectionIndex])
-		lp.globalConnectionChannel[previousConnectionIndex] <- "ABORT"
-		log.Printf("Closed previous connection (%d) from the same client (%s)\n", previousConnectionIndex, subscriptionID)
+	if retryAfter, tooFast := lp.listensTooFast(subscriptionID); tooFast == true {
+		lp.mutex.Unlock()
+		setRetryAfter(w, retryAfter)
+		sendError(w, 429, ErrorTooManyRequests, "Too many requests")
+		return
 	}
 
-	// Save the active connection for this client
-	lp.globalClientToConnection[subscriptionID] = currentConnection
+	// A client that passes the last event it received gets again all the
+	// following events, if they did not expire in the meantime
+	lastEventID, hasLastEventID := getLastEventID(r)
+	if hasLastEventID == true {
+		if lastEventID < lp.globalLastExpiredEvent {
+			lp.mutex.Unlock()
+			sendError(w, 410, ErrorEventsNotAvailable, "Events not available")
+			return
+		}
+		lp.replayEvents(subscriptionID, lastEventID)
+	}
 
-	// Create a comunication channel to receive async events
-	comunicationChannel := make(chan string)
-	lp.globalConnectionChannel[currentConnection] = comunicationChannel
+	// A subscription without feeds would wait until the timeout, every time
+	if len(lp.clientFeeds(subscriptionID)) == 0 && lp.hasEvents(subscriptionID) == false {
+		lp.mutex.Unlock()
+		sendError(w, 409, ErrorNoFeeds, "Subscription has no feeds")
+		return
+	}
 
-	// If they are no event, wait for the next one
-	if len(lp.globalClientToNewEvents[subscriptionID]) == 0 {
-		// Client is pending
-		lp.globalClients[subscriptionID] = true
+	if lp.connectionsLimitReached(subscriptionID) {
+		lp.mutex.Unlock()
+		sendError(w, 503, ErrorTooManyConnections, "Too many connections")
+		return
+	}
 
-		// Set a timeout every 5 seconds
-		go lp.notifyTimeout(comunicationChannel, 5)
+	// Shutdown waits for this request to be completed
+	lp.connections.Add(1)
+	defer lp.connections.Done()
+	defer lp.observeListen(lp.clock.Now())
 
-		log.Printf("Client %s (%d) waits for connection\n", subscriptionID, currentConnection)
-		operation := <-comunicationChannel
-		log.Printf("Client %s (%d) received signal %s\n", subscriptionID, currentConnection, operation)
+	currentConnection, comunicationChannel, previousChannel := lp.openConnection(subscriptionID)
+
+	if lp.onListenStart != nil {
+		go lp.onListenStart(subscriptionID)
+	}
+	clock := lp.clock
+	start, clientIP := clock.Now(), lp.clientIP(r)
+	reason, outcome, delivered := "DONE", "delivered", 0
+	defer func() {
+		lp.logListen(subscriptionID, requestID, clientIP, outcome, clock.Now().Sub(start), delivered)
+		lp.listenEnded(subscriptionID, reason)
+	}()
 
-		// Another connection from the same client, this one should be disharged
+	// If they are no event (or the subscription is paused), the client is
+	// pending and waits for the next one, unless it asked to respond
+	// immediately. With FlushOnAbort, the queued events are left to the
+	// aborted request, and this one waits for the following ones.
+	flushing := lp.flushOnAbort == true && previousChannel != nil
+	mustWait := (lp.hasEvents(subscriptionID) == false || lp.globalClientToPaused[subscriptionID] == true || flushing == true) && getWait(r) == true
+	lp.globalClients[subscriptionID] = mustWait
+
+	timeout := lp.clientTimeout(subscriptionID)
+	heartbeatInterval := lp.heartbeatInterval
+
+	// With an initial delay shorter than the timeout, the request responds
+	// with the empty list instead of timing out
+	emptyOnTimeout := false
+	if lp.initialDelay > 0 && lp.initialDelay < timeout {
+		timeout = lp.initialDelay
+		emptyOnTimeout = true
+	}
+
+	lp.mutex.Unlock()
+
+	// If the previous request was already terminating, nobody flushes the
+	// queue: this request is notified, so it delivers it
+	if lp.abortConnection(subscriptionID, previousChannel) == false && flushing == true {
+		go lp.notifyEvent(subscriptionID)
+	}
+
+	if mustWait {
+		// Heartbeats are whitespaces, so they can be sent only before JSON
+		_, isJSON := lp.serializerFor(r).(JSONSerializer)
+		if heartbeatInterval > 0 && isJSON {
+			if heartbeat := startHeartbeat(w, heartbeatInterval, lp.clock); heartbeat != nil {
+				w = heartbeat
+			}
+		}
+
+		// The lock must not be held here, or no event could be delivered
+		operation := lp.waitSignal(r.Context(), comunicationChannel, timeout)
+		if heartbeat, ok := w.(*heartbeatWriter); ok == true {
+			heartbeat.Stop()
+		}
+		reason, outcome = operation, strings.ToLower(operation)
+
+		// Another connection from the same client, this one should be disharged.
+		// Only a pending request is aborted, and a pending request was not
+		// notified of the new events yet: the queue is left untouched, and the
+		// new connection delivers it, unless the aborted one must flush it.
 		if operation == "ABORT" {
-			resthelper.SendError(w, 204, "Connection aborted")
-			log.Printf("Sent abort signal to %s (%d)\n", subscriptionID, currentConnection)
-			return
+			lp.mutex.Lock()
+			if lp.flushOnAbort == false || lp.hasEvents(subscriptionID) == false {
+				delete(lp.globalConnectionChannel, currentConnection)
+				lp.mutex.Unlock()
+				sendError(w, 204, ErrorConnectionAborted, "Connection aborted")
+				return
+			}
+			lp.mutex.Unlock()
 		}
 		// Timeout
-		if operation == "TIMEOUT" {
-			resthelper.SendError(w, 408, "Request timeout")
-			log.Printf("Sent timeout signal to %s (%d)\n", subscriptionID, currentConnection)
-			// Delete the connection, or next client will try to closed this one
-			// but it does not exist anymore and it would lock
-			delete(lp.globalClientToConnection, subscriptionID)
+		if operation == "TIMEOUT" && emptyOnTimeout == false {
+			lp.mutex.Lock()
+			lp.closeConnection(subscriptionID, currentConnection)
+			lp.mutex.Unlock()
+			// The client can listen again immediately
+			setRetryAfter(w, 0)
+			sendError(w, 408, ErrorRequestTimeout, "Request timeout")
+			return
+		}
+		// The client unsubscribed from all its feeds
+		if operation == "UNSUBSCRIBE" {
+			lp.mutex.Lock()
+			lp.closeConnection(subscriptionID, currentConnection)
+			lp.mutex.Unlock()
+			sendError(w, 410, ErrorSubscriptionRemoved, "Subscription removed")
+			return
+		}
+		// The client closed the connection, nobody reads the response
+		if operation == "DISCONNECT" {
+			lp.mutex.Lock()
+			lp.closeConnection(subscriptionID, currentConnection)
+			lp.mutex.Unlock()
+			return
+		}
+		// The server is shutting down
+		if operation == "SHUTDOWN" {
+			lp.mutex.Lock()
+			lp.closeConnection(subscriptionID, currentConnection)
+			lp.mutex.Unlock()
+			sendError(w, 503, ErrorServiceUnavailable, "Service unavailable")
 			return
 		}
 	}
 
-	// Fetch the events
+	lp.mutex.Lock()
+
+	limit := lp.maxEvents
+	if requestLimit, ok := getLimit(r); ok == true && (limit == 0 || requestLimit < limit) {
+		limit = requestLimit
+	}
+
 	var eventResponse EventResponse
-	eventResponse.Events = make([]event, 0)
-	for _, eventID := range lp.globalClientToNewEvents[subscriptionID] {
-		eventResponse.Events = append(eventResponse.Events, lp.globalEvents[eventID])
+	eventResponse.Events, eventResponse.HasMore = lp.fetchEvents(subscriptionID, true, limit)
+	eventResponse.LastEventID = lastEventID
+	for _, event := range eventResponse.Events {
+		if event.ID > eventResponse.LastEventID {
+			eventResponse.LastEventID = event.ID
+		}
 	}
 
-	// Clean the event list
-	lp.globalClientToNewEvents[subscriptionID] = make([]int, 0)
+	lp.closeConnection(subscriptionID, currentConnection)
+	lp.mutex.Unlock()
 
-	resthelper.SendResponse(w, eventResponse)
-	delete(lp.globalClientToConnection, subscriptionID)
+	eventResponse.Events = lp.transform(subscriptionID, eventResponse.Events)
+	eventResponse.Count = len(eventResponse.Events)
+	outcome, delivered = "delivered", eventResponse.Count
+	lp.sendResponse(w, r, wrap(eventResponse))
+}
+
+// logListen writes the access log line of a completed listen request, with
+// the fields separated by spaces as key=value pairs:
+//
+//	listen subscriptionID=... requestID=... clientIP=... outcome=timeout wait=5s events=0
+//
+// The outcome is delivered (the request responded with the events, or with
+// the empty list), timeout, abort, unsubscribe, disconnect or shutdown; wait
+// is the duration of the request.
+func (lp *LongPoll) logListen(subscriptionID string, requestID string, clientIP string, outcome string, wait time.Duration, events int) {
+	lp.logger.Printf("listen subscriptionID=%s requestID=%s clientIP=%s outcome=%s wait=%s events=%d\n",
+		subscriptionID, requestID, clientIP, outcome, wait.Round(time.Millisecond), events)
+}
+
+// listensTooFast checks if the previous listen request of the client started
+// less than the minimum interval ago, and returns how long the client should
+// wait, otherwise it records the start of the current one. It must be called
+// holding the lock.
+func (lp *LongPoll) listensTooFast(subscriptionID string) (time.Duration, bool) {
+	now := lp.clock.Now()
+	if lastListen, ok := lp.globalClientToLastListen[subscriptionID]; ok == true &&
+		lp.minListenInterval > 0 && now.Sub(lastListen) < lp.minListenInterval {
+		return lp.minListenInterval - now.Sub(lastListen), true
+	}
+	lp.globalClientToLastListen[subscriptionID] = now
+	return 0, false
+}
+
+// setRetryAfter sets the Retry-After header, in seconds (rounded up)
+func setRetryAfter(w http.ResponseWriter, retryAfter time.Duration) {
+	seconds := int((retryAfter + time.Second - 1) / time.Second)
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+}
+
+// connectionsLimitReached checks if a new connection for the client would
+// exceed the limit of open connections. It must be called holding the lock.
+func (lp *LongPoll) connectionsLimitReached(subscriptionID string) bool {
+	if lp.maxConnections == 0 {
+		return false
+	}
+	if _, hasConnection := lp.globalClientToConnection[subscriptionID]; hasConnection == true {
+		return false
+	}
+	return len(lp.globalClientToConnection) >= lp.maxConnections
+}
+
+// openConnection registers a new connection for the client, with its
+// comunication channel. It returns also the channel of the previous connection
+// of the same client, if it is still waiting, that must be aborted with
+// abortConnection once the lock is released. A previous connection that is
+// not waiting is already responding, and it does not need to be aborted. It
+// must be called holding the lock.
+func (lp *LongPoll) openConnection(subscriptionID string) (int, chan string, chan string) {
+	lp.globalLastConnection = lp.globalLastConnection + 1
+	currentConnection := lp.globalLastConnection
+	lp.globalClientToActivity[subscriptionID] = lp.clock.Now()
 
+	var previousChannel chan string
+	if previousConnection, ok := lp.globalClientToConnection[subscriptionID]; ok == true && lp.globalClients[subscriptionID] == true {
+		previousChannel = lp.globalConnectionChannel[previousConnection]
+	}
+
+	// Save the active connection for this client
+	lp.globalClientToConnection[subscriptionID] = currentConnection
+
+	// Create a comunication channel to receive async events. It keeps one
+	// signal, so a signal sent while the request is not receiving (yet) is
+	// not lost, and the sender does not block.
+	comunicationChannel := make(chan string, 1)
+	lp.globalConnectionChannel[currentConnection] = comunicationChannel
+
+	return currentConnection, comunicationChannel, previousChannel
 }
 
-// NewEvent sends an event (a generic object) to all the listening subscribers-
+// abortConnection sends the ABORT signal to the previous connection of a
+// client, and reports if it was sent. The channel keeps the signal until the
+// previous connection receives it. The signal is not sent if the channel
+// already holds another one: the previous connection is going to terminate
+// on its own, so waiting for it would lock the new request forever. It must
+// be called without holding the lock.
+func (lp *LongPoll) abortConnection(subscriptionID string, previousChannel chan string) bool {
+	if previousChannel == nil {
+		return false
+	}
+	select {
+	case previousChannel <- "ABORT":
+		lp.logger.Printf("Closed previous connection from the same client (%s)\n", subscriptionID)
+		return true
+	default:
+		lp.logger.Printf("Previous connection from the same client (%s) already terminated\n", subscriptionID)
+		return false
+	}
+}
+
+// hasEvents checks if there is something to deliver to a client: queued
+// events or, in ack mode, events still waiting for the acknowledgment. It must
+// be called holding the lock.
+func (lp *LongPoll) hasEvents(subscriptionID string) bool {
+	if len(lp.globalClientToNewEvents[subscriptionID]) > 0 {
+		return true
+	}
+	return lp.ackMode == true && len(lp.globalClientToInFlight[subscriptionID]) > 0
+}
+
+// fetchEvents returns the events queued for a client, and removes them from
+// the queue. In ack mode the events are moved to the in-flight ones, and they
+// are returned again (if resend is true) until they are acknowledged. If limit
+// is greater than zero, at most limit events are returned and the others stay
+// queued, in order: the returned bool reports if some events were left. Nothing
+// is returned while the subscription is paused. Every returned event gets the
+// next Sequence of the client, and a queued event that expired (also if its
+// own TTL elapsed, and the cleanup did not delete it yet) skips one. It
+// must be called holding the lock.
+func (lp *LongPoll) fetchEvents(subscriptionID string, resend bool, limit int) ([]Event, bool) {
+	if lp.globalClientToPaused[subscriptionID] == true {
+		return make([]Event, 0), false
+	}
+	queue := lp.globalClientToNewEvents[subscriptionID]
+	var inFlight []int
+	if lp.ackMode == true && resend == true {
+		inFlight = lp.globalClientToInFlight[subscriptionID]
+	}
+
+	fetched := queue
+	more := false
+	if limit > 0 && len(inFlight)+len(queue) > limit {
+		more = true
+		if len(inFlight) >= limit {
+			inFlight = inFlight[:limit]
+			fetched = nil
+		} else {
+			fetched = queue[:limit-len(inFlight)]
+		}
+	}
+	eventIDs := append(append(make([]int, 0), inFlight...), fetched...)
+
+	if lp.ackMode == true {
+		lp.globalClientToInFlight[subscriptionID] = append(lp.globalClientToInFlight[subscriptionID], fetched...)
+	}
+	if len(fetched) < len(queue) {
+		lp.globalClientToNewEvents[subscriptionID] = append(make([]int, 0), queue[len(fetched):]...)
+	} else {
+		delete(lp.globalClientToNewEvents, subscriptionID)
+	}
+
+	now := lp.clock.Now()
+	events := make([]Event, 0)
+	for i, eventID := range eventIDs {
+		event, exists := lp.eventStore.Load(eventID)
+		exists = exists == true && event.expired(now) == false
+		if exists == false && i < len(inFlight) {
+			continue
+		}
+		lp.globalClientToSequence[subscriptionID] = lp.globalClientToSequence[subscriptionID] + 1
+		if exists == true {
+			event.Sequence = lp.globalClientToSequence[subscriptionID]
+			events = append(events, event)
+		}
+	}
+	lp.deliveredEvents = lp.deliveredEvents + len(events)
+	return events, more
+}
+
+// closeConnection forgets a terminated connection. The client is detached from
+// the connection only if a newer one did not replace it in the meantime, or
+// the next request would try to abort a connection that does not exist
+// anymore. A signal left in the channel of the connection (sent while it was
+// terminating) is drained and dropped. It must be called holding the lock.
+func (lp *LongPoll) closeConnection(subscriptionID string, connection int) {
+	select {
+	case operation := <-lp.globalConnectionChannel[connection]:
+		lp.logger.Printf("Signal %s dropped: connection %s (%d) terminated\n", operation, subscriptionID, connection)
+	default:
+	}
+	delete(lp.globalConnectionChannel, connection)
+	if current, ok := lp.globalClientToConnection[subscriptionID]; ok == true && current == connection {
+		delete(lp.globalClientToConnection, subscriptionID)
+		lp.globalClients[subscriptionID] = false
+		lp.globalClientToActivity[subscriptionID] = lp.clock.Now()
+	}
+}
+
+// NewEvent sends an event (a generic object) to all the listening subscribers.
+// It returns an error if the feed does not exist.
 func (lp *LongPoll) NewEvent(feed string, object interface{}) error {
-	newIndex := len(lp.globalEvents)
-	lp.globalEvents[newIndex] = event{
-		Feed:      feed,
-		Data:      object,
-		Timestamp: int32(time.Now().Unix()),
+	return lp.NewEvents([]FeedEvent{{feed, object}})
+}
+
+// FeedEvent is an event (a generic object) to be published on a feed with
+// NewEvents
+type FeedEvent struct {
+	Feed string
+	Data interface{}
+}
+
+// NewEvents publishes more events at once. Each listening subscriber is
+// notified only once, even if it receives more events. It returns an error,
+// without publishing anything, if one of the feeds does not exist.
+// If a Broker is used, the events are sent also to the other instances.
+func (lp *LongPoll) NewEvents(feedEvents []FeedEvent) error {
+	waitingClients, err := lp.queueEvents(feedEvents, "")
+	if err != nil {
+		return err
+	}
+	for client := range waitingClients {
+		go lp.notifyEvent(client)
+	}
+	return lp.shareEvents(feedEvents)
+}
+
+// NewEventSync publishes an event like NewEvent, but it waits until all the
+// listening subscribers are notified, or the timeout elapses. It returns the
+// number of open connections that received the event; the subscribers that
+// are not listening just find the event in their queue, as usual. The event is
+// shared with the other instances (see UseBroker) also if the timeout
+// elapses.
+func (lp *LongPoll) NewEventSync(feed string, object interface{}, timeout time.Duration) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	feedEvents := []FeedEvent{{feed, object}}
+	waitingClients, err := lp.queueEvents(feedEvents, "")
+	if err != nil {
+		return 0, err
+	}
+	deliveredTo, notifyErr := lp.notifyClients(ctx, waitingClients)
+	err = lp.shareEvents(feedEvents)
+	if notifyErr != nil {
+		return deliveredTo, notifyErr
+	}
+	return deliveredTo, err
+}
+
+// NewEventContext publishes an event like NewEvent, but it waits until all
+// the listening subscribers are notified, or the context is done: in this
+// case the notifications still pending are abandoned, and the context error
+// is returned. The event stays queued for the subscribers that were not
+// notified, so they receive it with their next request, and it is shared with
+// the other instances (see UseBroker) anyway.
+func (lp *LongPoll) NewEventContext(ctx context.Context, feed string, object interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	feedEvents := []FeedEvent{{feed, object}}
+	waitingClients, err := lp.queueEvents(feedEvents, "")
+	if err != nil {
+		return err
+	}
+	_, notifyErr := lp.notifyClients(ctx, waitingClients)
+	err = lp.shareEvents(feedEvents)
+	if notifyErr != nil {
+		return notifyErr
+	}
+	return err
+}
+
+// notifyClients notifies the clients in parallel, and waits until all of them
+// are notified or the context is done. It returns the number of listen
+// requests that were woken up.
+func (lp *LongPoll) notifyClients(ctx context.Context, clients clientExist) (int, error) {
+	var deliveredTo int32
+	var notifications sync.WaitGroup
+	for client := range clients {
+		notifications.Add(1)
+		go func(client string) {
+			defer notifications.Done()
+			if lp.notifyEventContext(ctx, client) == true {
+				atomic.AddInt32(&deliveredTo, 1)
+			}
+		}(client)
+	}
+
+	completed := make(chan struct{})
+	go func() {
+		notifications.Wait()
+		close(completed)
+	}()
+
+	select {
+	case <-completed:
+		return int(atomic.LoadInt32(&deliveredTo)), nil
+	case <-ctx.Done():
+		return int(atomic.LoadInt32(&deliveredTo)), ctx.Err()
+	}
+}
+
+// NewEventExcluding publishes an event like NewEvent, but the excluded
+// subscriber does not receive it, even if it is subscribed to the feed. For
+// example the client that sent a chat message does not receive it back.
+func (lp *LongPoll) NewEventExcluding(feed string, object interface{}, excludeSubscriptionID string) error {
+	feedEvents := []FeedEvent{{feed, object}}
+	waitingClients, err := lp.queueEvents(feedEvents, excludeSubscriptionID)
+	if err != nil {
+		return err
+	}
+	for client := range waitingClients {
+		go lp.notifyEvent(client)
+	}
+	return lp.shareEvents(feedEvents)
+}
+
+// queueEvents stores the events and queues them for the subscribers of their
+// feeds, except the excluded one (if not empty). It returns the clients that
+// must be notified.
+func (lp *LongPoll) queueEvents(feedEvents []FeedEvent, excludedID string) (clientExist, error) {
+	lp.mutex.Lock()
+	defer lp.mutex.Unlock()
+
+	for _, feedEvent := range feedEvents {
+		if lp.feedAvailable(feedEvent.Feed) == false {
+			return nil, errors.New("feed " + feedEvent.Feed + " does not exist")
+		}
+		if err := lp.checkData(feedEvent.Data); err != nil {
+			return nil, err
+		}
 	}
 
 	// Find listening clients
-	waitingClients := make(map[string]bool)
-	for client := range lp.globalFeedToClients[feed] {
-		lp.globalClientToNewEvents[client] = append(lp.globalClientToNewEvents[client], newIndex)
-		waitingClients[client] = true
+	waitingClients := make(clientExist)
+	for _, feedEvent := range feedEvents {
+		lp.ensureFeed(feedEvent.Feed)
+		newEvent, err := lp.storeEvent(Event{Feed: feedEvent.Feed, Data: feedEvent.Data})
+		if err != nil {
+			return nil, err
+		}
+		// feedClients is a set: a client subscribed to the feed and to some
+		// matching patterns receives the event only once
+		clients := make(clientExist)
+		for client := range lp.feedClients(feedEvent.Feed) {
+			if client != excludedID {
+				clients[client] = true
+			}
+		}
+		for client := range lp.enqueueAll(clients, newEvent) {
+			waitingClients[client] = true
+		}
 	}
+	lp.reportOverflows()
 
+	return waitingClients, nil
+}
+
+// NewEventToFeeds publishes an event on more feeds at once. The event is
+// stored only once, and a subscriber of more of those feeds receives it only
+// once. It returns an error, without publishing anything, if one of the feeds
+// does not exist.
+func (lp *LongPoll) NewEventToFeeds(feeds []string, object interface{}) error {
+	feeds = uniqueFeeds(feeds)
+	if len(feeds) == 0 {
+		return errors.New("missing feed")
+	}
+
+	event := Event{Feed: feeds[0], Data: object}
+	if len(feeds) > 1 {
+		event.Feeds = feeds
+	}
+	return lp.publishEvent(event)
+}
+
+// publishEvent queues an event for the subscribers of its feeds, notifies
+// them and shares the event with the other instances
+func (lp *LongPoll) publishEvent(event Event) error {
+	waitingClients, err := lp.queueEvent(event)
+	if err != nil {
+		return err
+	}
 	for client := range waitingClients {
 		go lp.notifyEvent(client)
 	}
+	return lp.shareEvent(event)
+}
+
+// queueEvent stores an event and queues it for the subscribers of all its
+// feeds, or for all the clients if it is a broadcast. It returns the clients
+// that must be notified.
+func (lp *LongPoll) queueEvent(event Event) (clientExist, error) {
+	lp.mutex.Lock()
+	defer lp.mutex.Unlock()
+
+	var feeds []string
+	if event.isBroadcast() == false {
+		feeds = event.allFeeds()
+	}
+	for _, feed := range feeds {
+		if lp.feedAvailable(feed) == false {
+			return nil, errors.New("feed " + feed + " does not exist")
+		}
+	}
+	if err := lp.checkData(event.Data); err != nil {
+		return nil, err
+	}
+	for _, feed := range feeds {
+		lp.ensureFeed(feed)
+	}
+
+	newEvent, err := lp.storeEvent(event)
+	if err != nil {
+		return nil, err
+	}
+	clients := make(clientExist)
+	if event.isBroadcast() == true {
+		for client := range lp.globalClients {
+			clients[client] = true
+		}
+	}
+	for _, feed := range feeds {
+		for client := range lp.feedClients(feed) {
+			clients[client] = true
+		}
+	}
+	waitingClients := lp.enqueueAll(clients, newEvent)
+	lp.reportOverflows()
+	return waitingClients, nil
+}
+
+// Broadcast publishes an event (a generic object) to all the subscribed
+// clients, whatever their feeds, for example a server-wide announcement. The
+// event has no feed, and it is shared with the other instances if a broker is
+// used.
+func (lp *LongPoll) Broadcast(object interface{}) error {
+	return lp.publishEvent(Event{Data: object})
+}
+
+// NewEventForClient sends an event (a generic object) only to one subscriber,
+// even if other clients are subscribed to the same feed. It returns an error
+// if the subscription or the feed does not exist (as NewEvent).
+func (lp *LongPoll) NewEventForClient(subscriptionID string, feed string, object interface{}) error {
+	lp.mutex.Lock()
+	defer lp.mutex.Unlock()
+
+	if _, clientExists := lp.globalClients[subscriptionID]; clientExists == false {
+		return errors.New("subscription " + subscriptionID + " does not exist")
+	}
+	if lp.feedAvailable(feed) == false {
+		return errors.New("feed " + feed + " does not exist")
+	}
+	if err := lp.checkData(object); err != nil {
+		return err
+	}
+	lp.ensureFeed(feed)
+
+	newEvent, err := lp.storeEvent(Event{Feed: feed, Data: object, Recipient: subscriptionID})
+	if err != nil {
+		return err
+	}
+	if lp.enqueue(subscriptionID, newEvent) == true {
+		go lp.notifyEvent(subscriptionID)
+	}
+	lp.reportOverflows()
 
 	return nil
 }
 
-func (lp *LongPoll) notifyEvent(client string) {
-	if lp.globalClients[client] == true {
-		connection, ok := lp.globalClientToConnection[client]
-		if ok != true {
+// storeEvent saves a new event, setting its timestamp, and returns it with its
+// ID. Its data must be already checked with checkData. It must be called
+// holding the lock.
+func (lp *LongPoll) storeEvent(event Event) (Event, error) {
+	event.Timestamp = lp.clock.Now().UnixMilli()
+	newEvent, err := lp.eventStore.Save(event)
+	if err != nil {
+		return Event{}, err
+	}
+	if newEvent.ExpiresAt > 0 {
+		lp.expiringEvents[newEvent.ID] = newEvent.ExpiresAt
+		lp.startCleanup()
+	}
+	lp.retainEvent(newEvent.ID)
+	lp.publishedEvents = lp.publishedEvents + 1
+	return newEvent, nil
+}
+
+// notifyEvent wakes up the pending listen request of a client, if any, and
+// reports if a request was woken up. The client and its connection are
+// checked again under the lock, because the request could be terminated
+// (timeout, abort, unsubscribe...) after the event was queued, and so is the
+// queue: the event could have been removed in the meantime (for example by
+// RemoveFeed), and a request is not woken up only to respond without events.
+func (lp *LongPoll) notifyEvent(client string) bool {
+	return lp.notifyEventContext(context.Background(), client)
+}
+
+// notifyEventContext is like notifyEvent, but it gives up when the context is
+// done. In this case, or if the signal is dropped after the notify timeout,
+// the request is marked as pending again, so the next event can still wake it
+// up (and the event stays queued for the next listen request).
+func (lp *LongPoll) notifyEventContext(ctx context.Context, client string) bool {
+	lp.mutex.Lock()
+	if lp.globalClients[client] == false || lp.globalClientToPaused[client] == true || lp.hasEvents(client) == false {
+		lp.mutex.Unlock()
+		return false
+	}
+	connection, ok := lp.globalClientToConnection[client]
+	if ok != true {
+		lp.mutex.Unlock()
+		return false
+	}
+	comunicationChannel, ok := lp.globalConnectionChannel[connection]
+	if ok != true || comunicationChannel == nil {
+		lp.mutex.Unlock()
+		return false
+	}
+	lp.globalClients[client] = false
+	lp.mutex.Unlock()
+
+	if lp.notifyContext(ctx, comunicationChannel, "DONE") == true {
+		return true
+	}
+
+	lp.mutex.Lock()
+	if current, ok := lp.globalClientToConnection[client]; ok == true && current == connection {
+		lp.globalClients[client] = true
+	}
+	lp.mutex.Unlock()
+	return false
+}
+
+// notify sends a signal to a pending listen request. It must be called
+// without holding the lock. A send on a channel that was closed in the
+// meantime is logged instead of crashing the server.
+func (lp *LongPoll) notify(comunicationChannel chan string, operation string) bool {
+	return lp.notifyContext(context.Background(), comunicationChannel, operation)
+}
+
+// notifyContext is like notify, but it gives up when the context is done. In
+// both cases the signal is dropped if nobody receives it within the notify
+// timeout (see SetNotifyTimeout).
+func (lp *LongPoll) notifyContext(ctx context.Context, comunicationChannel chan string, operation string) (sent bool) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			lp.logger.Printf("Can not send signal %s: %v\n", operation, recovered)
+			sent = false
+		}
+	}()
+
+	lp.mutex.RLock()
+	notifyTimeout := lp.notifyTimeout
+	lp.mutex.RUnlock()
+	select {
+	case comunicationChannel <- operation:
+		return true
+	case <-ctx.Done():
+		return false
+	case <-lp.clock.After(notifyTimeout):
+		lp.logger.Printf("Signal %s dropped: nobody received it in %s\n", operation, notifyTimeout)
+		return false
+	}
+}
+
+// cleanupLoop periodically deletes the expired events (also the ones published
+// with NewEventWithTTL), the idle subscriptions and the expired IDs passed to
+// NewEventWithID, until the shutdown
+func (lp *LongPoll) cleanupLoop() {
+	for {
+		select {
+		case <-lp.done:
 			return
+		case <-lp.clock.After(cleanupInterval):
+		}
+		lp.mutex.Lock()
+		if lp.eventTTL > 0 {
+			lp.deleteEventsOlderThan(lp.clock.Now().Add(-lp.eventTTL))
 		}
-		lp.globalConnectionChannel[connection] <- "DONE"
-		lp.globalClients[client] = false
+		lp.deleteExpiringEvents(lp.clock.Now())
+		if lp.subscriptionTTL > 0 {
+			lp.deleteClientsIdleSince(lp.clock.Now().Add(-lp.subscriptionTTL))
+		}
+		lp.deletePublishedIDsOlderThan(lp.clock.Now().Add(-lp.deduplicationTTL))
+		lp.mutex.Unlock()
 	}
 }
 
-func (lp *LongPoll) notifyTimeout(comunicationChanel chan string, seconds int) {
-	time.Sleep(time.Duration(seconds) * time.Second)
-	comunicationChanel <- "TIMEOUT"
+// deleteEventsOlderThan deletes the events created before the passed time,
+// removing them also from the client queues. It must be called holding the
+// lock.
+func (lp *LongPoll) deleteEventsOlderThan(limit time.Time) {
+	expired := make(map[int]bool)
+	for _, eventID := range lp.eventStore.PruneOlderThan(limit.UnixMilli()) {
+		expired[eventID] = true
+		if eventID > lp.globalLastExpiredEvent {
+			lp.globalLastExpiredEvent = eventID
+		}
+	}
+	lp.deleteEvents(expired)
+}
+
+// deleteClientsIdleSince deletes the clients without an open connection and
+// without any activity after the passed time. It must be called holding the
+// lock.
+func (lp *LongPoll) deleteClientsIdleSince(limit time.Time) {
+	for client := range lp.globalClients {
+		if _, hasConnection := lp.globalClientToConnection[client]; hasConnection == true {
+			continue
+		}
+		if lp.globalClientToActivity[client].Before(limit) {
+			lp.logger.Printf("Subscription %s expired\n", client)
+			lp.removeClient(client)
+		}
+	}
+}
+
+// deleteEvents deletes the passed events, removing them also from the client
+// queues: the events that were still queued skip their Sequence numbers, so
+// the clients see the gap. It must be called holding the lock.
+func (lp *LongPoll) deleteEvents(eventIDs map[int]bool) {
+	if len(eventIDs) == 0 {
+		return
+	}
+	deleted := make([]int, 0, len(eventIDs))
+	for eventID := range eventIDs {
+		deleted = append(deleted, eventID)
+	}
+	lp.eventStore.Delete(deleted)
+	if lp.maxRetainedEvents > 0 {
+		lp.retainedEvents = removeEventIDs(lp.retainedEvents, eventIDs)
+	}
+	for client, queue := range lp.globalClientToNewEvents {
+		pending := removeEventIDs(queue, eventIDs)
+		lp.globalClientToSequence[client] = lp.globalClientToSequence[client] + len(queue) - len(pending)
+		lp.globalClientToNewEvents[client] = pending
+	}
+	for client, queue := range lp.globalClientToInFlight {
+		lp.globalClientToInFlight[client] = removeEventIDs(queue, eventIDs)
+	}
+}
+
+// removeEventIDs returns a copy of the queue without the passed events
+func removeEventIDs(queue []int, eventIDs map[int]bool) []int {
+	pending := make([]int, 0, len(queue))
+	for _, eventID := range queue {
+		if eventIDs[eventID] == false {
+			pending = append(pending, eventID)
+		}
+	}
+	return pending
+}
+
+// waitSignal waits for a signal on the comunication channel, returning
+// "TIMEOUT" if nothing is received in time, or "DISCONNECT" if the request
+// context is done (the client went away).
+func (lp *LongPoll) waitSignal(ctx context.Context, comunicationChannel chan string, timeout time.Duration) string {
+	select {
+	case operation := <-comunicationChannel:
+		return operation
+	case <-lp.clock.After(timeout):
+		return "TIMEOUT"
+	case <-ctx.Done():
+		return "DISCONNECT"
+	}
+}
+
+// Shutdown stops accepting new subscriptions and listen requests, releases
+// all the pending listen requests (that respond with 503) and waits for the
+// outstanding ones to complete, or for the context to expire.
+func (lp *LongPoll) Shutdown(ctx context.Context) error {
+	lp.mutex.Lock()
+	if lp.shutdown == false {
+		lp.shutdown = true
+		close(lp.done)
+	}
+	pendingChannels := make([]chan string, 0)
+	for client, pending := range lp.globalClients {
+		if pending == true {
+			connection := lp.globalClientToConnection[client]
+			pendingChannels = append(pendingChannels, lp.globalConnectionChannel[connection])
+			lp.globalClients[client] = false
+		}
+	}
+	lp.mutex.Unlock()
+
+	for _, comunicationChannel := range pendingChannels {
+		go lp.notify(comunicationChannel, "SHUTDOWN")
+	}
+
+	completed := make(chan struct{})
+	go func() {
+		lp.connections.Wait()
+		close(completed)
+	}()
+
+	select {
+	case <-completed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
@@ -0,0 +1,1340 @@
+package longpoll
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// subscribe subscribes a client with the query-string, and returns its
+// subscriptionID
+func subscribe(t *testing.T, lp *LongPoll, query string) string {
+	t.Helper()
+	w := httptest.NewRecorder()
+	lp.SubscribeHandler(w, httptest.NewRequest("GET", "/subscribe?"+query, nil))
+	var response SubscriptionResponse
+	json.Unmarshal(w.Body.Bytes(), &response)
+	if response.SubscriptionID == "" {
+		t.Fatalf("subscribe %s: %d %s", query, w.Code, w.Body.String())
+	}
+	return response.SubscriptionID
+}
+
+// listen sends a listen request with the query-string, and waits for the
+// response
+func listen(lp *LongPoll, query string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	lp.ListenHandler(w, httptest.NewRequest("GET", "/listen?"+query, nil))
+	return w
+}
+
+// decodeEvents decodes the events of a listen response
+func decodeEvents(t *testing.T, w *httptest.ResponseRecorder) EventResponse {
+	t.Helper()
+	var response EventResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("decode %d %s: %s", w.Code, w.Body.String(), err)
+	}
+	return response
+}
+
+// waitListening waits until the subscription has a pending listen request
+func waitListening(t *testing.T, lp *LongPoll, subscriptionID string) {
+	t.Helper()
+	for i := 0; i < 200; i++ {
+		if info, exists := lp.GetSubscription(subscriptionID); exists == true && info.Listening == true {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("%s is not listening", subscriptionID)
+}
+
+// fakeClock is a Clock whose time moves only with advance, and whose timers
+// fire only with fire
+type fakeClock struct {
+	sync.Mutex
+	now     time.Time
+	waiters []chan time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.Lock()
+	defer c.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.Lock()
+	defer c.Unlock()
+	waiter := make(chan time.Time, 1)
+	c.waiters = append(c.waiters, waiter)
+	return waiter
+}
+
+// advance moves the time forward
+func (c *fakeClock) advance(d time.Duration) {
+	c.Lock()
+	c.now = c.now.Add(d)
+	c.Unlock()
+}
+
+// fire releases all the pending After calls
+func (c *fakeClock) fire() {
+	c.Lock()
+	defer c.Unlock()
+	for _, waiter := range c.waiters {
+		waiter <- c.now
+	}
+	c.waiters = nil
+}
+
+// logRecorder is a Logger that keeps the log lines
+type logRecorder struct {
+	sync.Mutex
+	lines []string
+}
+
+func (l *logRecorder) Printf(format string, v ...interface{}) {
+	l.Lock()
+	l.lines = append(l.lines, fmt.Sprintf(format, v...))
+	l.Unlock()
+}
+
+// find returns the log lines that start with prefix
+func (l *logRecorder) find(prefix string) []string {
+	l.Lock()
+	defer l.Unlock()
+	var found []string
+	for _, line := range l.lines {
+		if strings.HasPrefix(line, prefix) {
+			found = append(found, line)
+		}
+	}
+	return found
+}
+
+func TestConcurrentAccess(t *testing.T) {
+	lp := New()
+	lp.AddFeed("feed1")
+	lp.SetTimeout(100 * time.Millisecond)
+	subscriptionIDs := make([]string, 50)
+	for i := range subscriptionIDs {
+		subscriptionIDs[i] = subscribe(t, lp, "feed=feed1")
+	}
+
+	var wg sync.WaitGroup
+	for _, subscriptionID := range subscriptionIDs {
+		wg.Add(2)
+		go func(subscriptionID string) {
+			defer wg.Done()
+			listen(lp, "subscriptionID="+subscriptionID)
+		}(subscriptionID)
+		go func() {
+			defer wg.Done()
+			subscribe(t, lp, "feed=feed1")
+		}()
+	}
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := lp.NewEvent("feed1", fmt.Sprint(i)); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestSetTimeout(t *testing.T) {
+	lp := New()
+	for _, timeout := range []time.Duration{0, -time.Second} {
+		if err := lp.SetTimeout(timeout); err == nil {
+			t.Fatalf("timeout %s accepted", timeout)
+		}
+	}
+	if err := lp.SetTimeout(50 * time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	lp.AddFeed("feed1")
+	subscriptionID := subscribe(t, lp, "feed=feed1")
+
+	start := time.Now()
+	w := listen(lp, "subscriptionID="+subscriptionID)
+	if w.Code != 408 {
+		t.Fatalf("expected 408, got %d %s", w.Code, w.Body.String())
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond || elapsed > time.Second {
+		t.Fatalf("timed out after %s", elapsed)
+	}
+}
+
+func TestUnsubscribe(t *testing.T) {
+	lp := New()
+	lp.AddFeeds([]string{"feed1", "feed2"})
+	subscriptionID := subscribe(t, lp, "feed=feed1&feed=feed2")
+
+	w := httptest.NewRecorder()
+	lp.UnsubscribeHandler(w, httptest.NewRequest("GET", "/unsubscribe?subscriptionID="+subscriptionID+"&feed=feed1", nil))
+	if w.Code != 200 || strings.Contains(w.Body.String(), `"feeds":["feed2"]`) == false {
+		t.Fatalf("unsubscribe from feed1: %d %s", w.Code, w.Body.String())
+	}
+	if err := lp.Unsubscribe("unknown", nil); err == nil {
+		t.Fatal("unknown subscription unsubscribed")
+	}
+}
+
+func TestUnsubscribeMidListen(t *testing.T) {
+	lp := New()
+	lp.AddFeed("feed1")
+	subscriptionID := subscribe(t, lp, "feed=feed1")
+
+	done := make(chan int)
+	go func() { done <- listen(lp, "subscriptionID="+subscriptionID).Code }()
+	waitListening(t, lp, subscriptionID)
+	if err := lp.Unsubscribe(subscriptionID, nil); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case code := <-done:
+		if code != 410 {
+			t.Fatalf("expected 410, got %d", code)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the listen request did not return")
+	}
+	if code := listen(lp, "subscriptionID="+subscriptionID).Code; code != 401 {
+		t.Fatalf("expected 401 after the unsubscription, got %d", code)
+	}
+}
+
+func TestEventTTL(t *testing.T) {
+	lp := New()
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	lp.SetClock(clock)
+	lp.AddFeed("feed1")
+	subscriptionID := subscribe(t, lp, "feed=feed1")
+	lp.SetEventTTL(time.Minute)
+
+	lp.NewEvent("feed1", "old")
+	clock.advance(2 * time.Minute)
+	lp.NewEvent("feed1", "new")
+
+	lp.mutex.Lock()
+	lp.deleteEventsOlderThan(clock.Now().Add(-lp.eventTTL))
+	lp.mutex.Unlock()
+
+	if stored := lp.eventStore.LoadSince("feed1", 0); len(stored) != 1 || stored[0].Data != "new" {
+		t.Fatalf("stored events: %+v", stored)
+	}
+	if events := lp.DrainEvents(subscriptionID); len(events) != 1 || events[0].Data != "new" {
+		t.Fatalf("queued events: %+v", events)
+	}
+}
+
+func TestNewEventUnknownFeed(t *testing.T) {
+	lp := New()
+	lp.AddFeed("feed1")
+	subscriptionID := subscribe(t, lp, "feed=feed1")
+
+	if err := lp.NewEvent("feed2", "lost"); err == nil || err.Error() != "feed feed2 does not exist" {
+		t.Fatalf("NewEvent: %v", err)
+	}
+	if err := lp.NewEventForClient(subscriptionID, "feed2", "lost"); err == nil || err.Error() != "feed feed2 does not exist" {
+		t.Fatalf("NewEventForClient: %v", err)
+	}
+	if stored := lp.eventStore.LoadSince("", 0); len(stored) != 0 {
+		t.Fatalf("orphaned events stored: %+v", stored)
+	}
+	if events := lp.DrainEvents(subscriptionID); len(events) != 0 {
+		t.Fatalf("orphaned events queued: %+v", events)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	goroutines := runtime.NumGoroutine()
+	lp := New()
+	lp.AddFeed("feed1")
+	lp.SetEventTTL(time.Minute)
+	subscriptionID := subscribe(t, lp, "feed=feed1")
+
+	done := make(chan int)
+	go func() { done <- listen(lp, "subscriptionID="+subscriptionID).Code }()
+	waitListening(t, lp, subscriptionID)
+	if err := lp.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if code := <-done; code != 503 {
+		t.Fatalf("pending listen: expected 503, got %d", code)
+	}
+
+	w := httptest.NewRecorder()
+	lp.SubscribeHandler(w, httptest.NewRequest("GET", "/subscribe?feed=feed1", nil))
+	if w.Code != 503 {
+		t.Fatalf("subscribe after the shutdown: expected 503, got %d", w.Code)
+	}
+	if code := listen(lp, "subscriptionID="+subscriptionID).Code; code != 503 {
+		t.Fatalf("listen after the shutdown: expected 503, got %d", code)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	if running := runtime.NumGoroutine(); running > goroutines {
+		t.Fatalf("%d goroutines running after the shutdown, %d before", running, goroutines)
+	}
+}
+
+func TestListenClientDisconnect(t *testing.T) {
+	lp := New()
+	lp.AddFeed("feed1")
+	subscriptionID := subscribe(t, lp, "feed=feed1")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r := httptest.NewRequest("GET", "/listen?subscriptionID="+subscriptionID, nil).WithContext(ctx)
+	done := make(chan struct{})
+	go func() {
+		lp.ListenHandler(httptest.NewRecorder(), r)
+		close(done)
+	}()
+	waitListening(t, lp, subscriptionID)
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("the listen request did not return")
+	}
+
+	lp.mutex.RLock()
+	defer lp.mutex.RUnlock()
+	if len(lp.globalClientToConnection) != 0 || len(lp.globalConnectionChannel) != 0 {
+		t.Fatalf("connection not cleaned up: %v %v", lp.globalClientToConnection, lp.globalConnectionChannel)
+	}
+}
+
+func TestRemoveFeed(t *testing.T) {
+	lp := New()
+	lp.AddFeeds([]string{"feed1", "feed2"})
+	onlyFeed1 := subscribe(t, lp, "feed=feed1")
+	bothFeeds := subscribe(t, lp, "feed=feed1&feed=feed2")
+	lp.NewEvent("feed1", "removed")
+
+	if err := lp.RemoveFeed("unknown"); err == nil {
+		t.Fatal("unknown feed removed")
+	}
+	lp.DrainEvents(onlyFeed1)
+	done := make(chan int)
+	go func() { done <- listen(lp, "subscriptionID="+onlyFeed1).Code }()
+	waitListening(t, lp, onlyFeed1)
+	if err := lp.RemoveFeed("feed1"); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case code := <-done:
+		if code != 410 {
+			t.Fatalf("pending listen: expected 410, got %d", code)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the listen request did not return")
+	}
+	if code := listen(lp, "subscriptionID="+onlyFeed1).Code; code != 401 {
+		t.Fatalf("next listen: expected 401, got %d", code)
+	}
+	info, exists := lp.GetSubscription(bothFeeds)
+	if exists == false || len(info.Feeds) != 1 || info.Feeds[0] != "feed2" {
+		t.Fatalf("subscription to both the feeds: %+v", info)
+	}
+	if events := lp.DrainEvents(bothFeeds); len(events) != 0 {
+		t.Fatalf("events of the removed feed still queued: %+v", events)
+	}
+	if feeds := lp.ListFeeds(); len(feeds) != 1 || feeds[0] != "feed2" {
+		t.Fatalf("feeds: %v", feeds)
+	}
+}
+
+func TestFeedTimeout(t *testing.T) {
+	lp := New()
+	lp.AddFeeds([]string{"slow", "fast"})
+	lp.SetTimeout(time.Hour)
+	if err := lp.SetFeedTimeout("unknown", time.Second); err == nil {
+		t.Fatal("timeout set for an unknown feed")
+	}
+	lp.SetFeedTimeout("slow", time.Minute)
+	lp.SetFeedTimeout("fast", 50*time.Millisecond)
+	subscriptionID := subscribe(t, lp, "feed=slow&feed=fast")
+
+	start := time.Now()
+	if code := listen(lp, "subscriptionID="+subscriptionID).Code; code != 408 {
+		t.Fatalf("expected 408, got %d", code)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("timed out after %s, not with the shortest feed timeout", elapsed)
+	}
+}
+
+func TestNewEvents(t *testing.T) {
+	lp := New()
+	lp.AddFeeds([]string{"feed1", "feed2"})
+	subscriptionID := subscribe(t, lp, "feed=feed1&feed=feed2")
+
+	err := lp.NewEvents([]FeedEvent{{"feed1", 1}, {"unknown", 2}})
+	if err == nil {
+		t.Fatal("batch with an unknown feed published")
+	}
+	if stored := lp.eventStore.LoadSince("", 0); len(stored) != 0 {
+		t.Fatalf("partial batch stored: %+v", stored)
+	}
+
+	if err := lp.NewEvents([]FeedEvent{{"feed1", 1}, {"feed2", 2}, {"feed1", 3}}); err != nil {
+		t.Fatal(err)
+	}
+	events := decodeEvents(t, listen(lp, "subscriptionID="+subscriptionID)).Events
+	if len(events) != 3 {
+		t.Fatalf("expected 3 events, got %+v", events)
+	}
+	for i, event := range events {
+		if event.Data != float64(i+1) {
+			t.Fatalf("event %d out of order: %+v", i, events)
+		}
+	}
+}
+
+// benchmarkPublish publishes b.N events to a feed with 100 subscribers, in
+// batches of the passed size
+func benchmarkPublish(b *testing.B, batchSize int) {
+	lp := New()
+	lp.SetLogger(log.New(io.Discard, "", 0))
+	lp.AddFeed("feed1")
+	for i := 0; i < 100; i++ {
+		w := httptest.NewRecorder()
+		lp.SubscribeHandler(w, httptest.NewRequest("GET", "/subscribe?feed=feed1", nil))
+	}
+	feedEvents := make([]FeedEvent, batchSize)
+	for i := range feedEvents {
+		feedEvents[i] = FeedEvent{"feed1", i}
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i += batchSize {
+		if batchSize == 1 {
+			lp.NewEvent("feed1", i)
+		} else {
+			lp.NewEvents(feedEvents)
+		}
+	}
+}
+
+func BenchmarkNewEvent(b *testing.B) {
+	benchmarkPublish(b, 1)
+}
+
+func BenchmarkNewEvents(b *testing.B) {
+	benchmarkPublish(b, 100)
+}
+
+func TestMaxConnections(t *testing.T) {
+	lp := New()
+	lp.AddFeed("feed1")
+	lp.SetMaxConnections(3)
+	subscriptionIDs := make([]string, 4)
+	for i := range subscriptionIDs {
+		subscriptionIDs[i] = subscribe(t, lp, "feed=feed1")
+	}
+
+	var wg sync.WaitGroup
+	for _, subscriptionID := range subscriptionIDs[:3] {
+		wg.Add(1)
+		go func(subscriptionID string) {
+			defer wg.Done()
+			listen(lp, "subscriptionID="+subscriptionID)
+		}(subscriptionID)
+		waitListening(t, lp, subscriptionID)
+	}
+	if code := listen(lp, "subscriptionID="+subscriptionIDs[3]).Code; code != 503 {
+		t.Fatalf("expected 503 over the limit, got %d", code)
+	}
+
+	lp.NewEvent("feed1", "release")
+	wg.Wait()
+	lp.NewEvent("feed1", "next")
+	if code := listen(lp, "subscriptionID="+subscriptionIDs[3]).Code; code != 200 {
+		t.Fatalf("expected 200 after the connections closed, got %d", code)
+	}
+}
+
+func TestListenWithoutWaiting(t *testing.T) {
+	lp := New()
+	lp.AddFeed("feed1")
+	lp.SetTimeout(time.Hour)
+	subscriptionID := subscribe(t, lp, "feed=feed1")
+
+	w := listen(lp, "subscriptionID="+subscriptionID+"&wait=false")
+	if w.Code != 200 || len(decodeEvents(t, w).Events) != 0 {
+		t.Fatalf("empty queue: %d %s", w.Code, w.Body.String())
+	}
+
+	lp.NewEvent("feed1", "queued")
+	w = listen(lp, "subscriptionID="+subscriptionID+"&wait=false")
+	if events := decodeEvents(t, w).Events; w.Code != 200 || len(events) != 1 || events[0].Data != "queued" {
+		t.Fatalf("queued event: %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestDuplicateFeedSubscription(t *testing.T) {
+	lp := New()
+	lp.AddFeed("feed1")
+	subscriptionID := subscribe(t, lp, "feed=feed1&feed=feed1")
+
+	lp.NewEvent("feed1", "once")
+	if events := decodeEvents(t, listen(lp, "subscriptionID="+subscriptionID)).Events; len(events) != 1 {
+		t.Fatalf("expected a single event, got %+v", events)
+	}
+}
+
+func TestTimeoutsAndPublishes(t *testing.T) {
+	lp := New()
+	lp.AddFeed("feed1")
+	lp.SetTimeout(5 * time.Millisecond)
+	subscriptionID := subscribe(t, lp, "feed=feed1")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 200; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			listen(lp, "subscriptionID="+subscriptionID)
+		}()
+		go func(i int) {
+			defer wg.Done()
+			lp.NewEvent("feed1", i)
+		}(i)
+		time.Sleep(time.Millisecond)
+	}
+	finished := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(5 * time.Second):
+		t.Fatal("deadlock")
+	}
+}
+
+func TestRapidReconnect(t *testing.T) {
+	lp := New()
+	lp.AddFeed("feed1")
+	lp.SetTimeout(20 * time.Millisecond)
+	subscriptionID := subscribe(t, lp, "feed=feed1")
+
+	if code := listen(lp, "subscriptionID="+subscriptionID).Code; code != 408 {
+		t.Fatalf("first listen: expected 408, got %d", code)
+	}
+	lp.SetTimeout(200 * time.Millisecond)
+	var wg sync.WaitGroup
+	for i := 0; i < 200; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			listen(lp, "subscriptionID="+subscriptionID)
+		}()
+		if i%10 == 0 {
+			lp.NewEvent("feed1", i)
+		}
+	}
+	finished := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(5 * time.Second):
+		t.Fatal("deadlock")
+	}
+
+	lp.mutex.RLock()
+	defer lp.mutex.RUnlock()
+	if len(lp.globalConnectionChannel) != 0 || len(lp.globalClientToConnection) != 0 || lp.globalClients[subscriptionID] == true {
+		t.Fatalf("connections left open: %v %v", lp.globalConnectionChannel, lp.globalClientToConnection)
+	}
+}
+
+func TestSubscriptionTTL(t *testing.T) {
+	lp := New()
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	lp.SetClock(clock)
+	lp.AddFeed("feed1")
+	lp.SetSubscriptionTTL(time.Minute)
+	idle := subscribe(t, lp, "feed=feed1")
+	clock.advance(50 * time.Second)
+	active := subscribe(t, lp, "feed=feed1")
+	clock.advance(20 * time.Second)
+
+	lp.mutex.Lock()
+	lp.deleteClientsIdleSince(clock.Now().Add(-lp.subscriptionTTL))
+	lp.mutex.Unlock()
+
+	if code := listen(lp, "subscriptionID="+idle+"&wait=false").Code; code != 401 {
+		t.Fatalf("idle subscription: expected 401, got %d", code)
+	}
+	if code := listen(lp, "subscriptionID="+active+"&wait=false").Code; code != 200 {
+		t.Fatalf("active subscription: expected 200, got %d", code)
+	}
+}
+
+func TestListenLimit(t *testing.T) {
+	lp := New()
+	lp.AddFeed("feed1")
+	subscriptionID := subscribe(t, lp, "feed=feed1")
+	for i := 0; i < 5; i++ {
+		lp.NewEvent("feed1", i)
+	}
+
+	response := decodeEvents(t, listen(lp, "subscriptionID="+subscriptionID+"&limit=2"))
+	if len(response.Events) != 2 || response.HasMore == false || response.Events[0].Data != float64(0) {
+		t.Fatalf("limit=2: %+v", response)
+	}
+	response = decodeEvents(t, listen(lp, "subscriptionID="+subscriptionID+"&limit=3"))
+	if len(response.Events) != 3 || response.HasMore == true || response.Events[0].Data != float64(2) {
+		t.Fatalf("limit=3 with 3 events queued: %+v", response)
+	}
+
+	lp.SetMaxEvents(1)
+	lp.NewEvent("feed1", 5)
+	lp.NewEvent("feed1", 6)
+	response = decodeEvents(t, listen(lp, "subscriptionID="+subscriptionID+"&limit=10"))
+	if len(response.Events) != 1 || response.HasMore == false || response.Events[0].Data != float64(5) {
+		t.Fatalf("limit capped by SetMaxEvents: %+v", response)
+	}
+}
+
+func TestMinListenInterval(t *testing.T) {
+	lp := New()
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	lp.SetClock(clock)
+	lp.AddFeed("feed1")
+	lp.SetMinListenInterval(time.Second)
+	subscriptionID := subscribe(t, lp, "feed=feed1")
+
+	if code := listen(lp, "subscriptionID="+subscriptionID+"&wait=false").Code; code != 200 {
+		t.Fatalf("first listen: expected 200, got %d", code)
+	}
+	clock.advance(100 * time.Millisecond)
+	w := listen(lp, "subscriptionID="+subscriptionID+"&wait=false")
+	if w.Code != 429 || w.Header().Get("Retry-After") == "" {
+		t.Fatalf("listen too fast: expected 429 with Retry-After, got %d", w.Code)
+	}
+	for i := 0; i < 3; i++ {
+		clock.advance(time.Second)
+		if code := listen(lp, "subscriptionID="+subscriptionID+"&wait=false").Code; code != 200 {
+			t.Fatalf("listen at a reasonable cadence: expected 200, got %d", code)
+		}
+	}
+}
+
+func TestDynamicFeeds(t *testing.T) {
+	lp := New()
+	w := httptest.NewRecorder()
+	lp.SubscribeHandler(w, httptest.NewRequest("GET", "/subscribe?feed=room1", nil))
+	if w.Code != 409 {
+		t.Fatalf("strict mode: expected 409, got %d", w.Code)
+	}
+	if err := lp.NewEvent("room1", 1); err == nil {
+		t.Fatal("strict mode: published to an unknown feed")
+	}
+
+	lp.AllowDynamicFeeds(true)
+	subscriptionID := subscribe(t, lp, "feed=room1")
+	if err := lp.NewEvent("room2", 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := lp.NewEvent("room1", 2); err != nil {
+		t.Fatal(err)
+	}
+	if events := lp.DrainEvents(subscriptionID); len(events) != 1 || events[0].Data != 2 {
+		t.Fatalf("dynamic mode: %+v", events)
+	}
+	if feeds := lp.ListFeeds(); len(feeds) != 2 {
+		t.Fatalf("feeds: %v", feeds)
+	}
+}
+
+func TestNewEventExcluding(t *testing.T) {
+	lp := New()
+	lp.AddFeed("feed1")
+	sender := subscribe(t, lp, "feed=feed1")
+	receiver := subscribe(t, lp, "feed=feed1")
+
+	if err := lp.NewEventExcluding("feed1", "hello", sender); err != nil {
+		t.Fatal(err)
+	}
+	if events := lp.DrainEvents(sender); len(events) != 0 {
+		t.Fatalf("excluded client received %+v", events)
+	}
+	if events := lp.DrainEvents(receiver); len(events) != 1 || events[0].Data != "hello" {
+		t.Fatalf("other client received %+v", events)
+	}
+}
+
+func TestNewEventToFeeds(t *testing.T) {
+	lp := New()
+	lp.AddFeeds([]string{"feed1", "feed2", "feed3"})
+	twoFeeds := subscribe(t, lp, "feed=feed1&feed=feed2")
+	oneFeed := subscribe(t, lp, "feed=feed3")
+
+	if err := lp.NewEventToFeeds([]string{"feed1", "unknown"}, "lost"); err == nil {
+		t.Fatal("published to an unknown feed")
+	}
+	if err := lp.NewEventToFeeds([]string{"feed1", "feed2", "feed3"}, "once"); err != nil {
+		t.Fatal(err)
+	}
+	if events := lp.DrainEvents(twoFeeds); len(events) != 1 || events[0].Data != "once" {
+		t.Fatalf("client subscribed to two of the feeds: %+v", events)
+	}
+	if events := lp.DrainEvents(oneFeed); len(events) != 1 || events[0].Data != "once" {
+		t.Fatalf("client subscribed to one of the feeds: %+v", events)
+	}
+}
+
+func TestRemoveFeedKeepsSharedEvents(t *testing.T) {
+	lp := New()
+	lp.AddFeeds([]string{"a", "b", "c"})
+	onB := subscribe(t, lp, "feed=b")
+	onAC := subscribe(t, lp, "feed=a&feed=c")
+	lp.NewEventToFeeds([]string{"a", "b"}, "shared")
+	lp.NewEvent("a", "only a")
+
+	if err := lp.RemoveFeed("a"); err != nil {
+		t.Fatal(err)
+	}
+	if events := lp.DrainEvents(onB); len(events) != 1 || events[0].Data != "shared" {
+		t.Fatalf("subscriber of b: %+v", events)
+	}
+	if events := lp.DrainEvents(onAC); len(events) != 0 {
+		t.Fatalf("subscriber of a and c: %+v", events)
+	}
+	stored := lp.eventStore.LoadSince("", 0)
+	if len(stored) != 1 || stored[0].Feed != "b" || len(stored[0].Feeds) != 0 {
+		t.Fatalf("stored events: %+v", stored)
+	}
+
+	late := subscribe(t, lp, "feed=b&backlog=5")
+	if events := lp.DrainEvents(late); len(events) != 1 || events[0].Data != "shared" {
+		t.Fatalf("backlog of b: %+v", events)
+	}
+}
+
+func TestSubscribeBacklog(t *testing.T) {
+	lp := New()
+	lp.AddFeeds([]string{"feed1", "feed2"})
+	for i := 0; i < 5; i++ {
+		lp.NewEvent("feed1", i)
+		lp.NewEvent("feed2", 100+i)
+	}
+
+	subscriptionID := subscribe(t, lp, "feed=feed1&backlog=3")
+	events := decodeEvents(t, listen(lp, "subscriptionID="+subscriptionID+"&wait=false")).Events
+	if len(events) != 3 {
+		t.Fatalf("expected the last 3 events of feed1, got %+v", events)
+	}
+	for i, event := range events {
+		if event.Feed != "feed1" || event.Data != float64(i+2) {
+			t.Fatalf("expected the last 3 events of feed1, got %+v", events)
+		}
+	}
+}
+
+func TestEventIDs(t *testing.T) {
+	lp := New()
+	lp.AddFeed("feed1")
+	subscriptionID := subscribe(t, lp, "feed=feed1")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			lp.NewEvent("feed1", i)
+		}(i)
+	}
+	wg.Wait()
+	events := lp.DrainEvents(subscriptionID)
+	if len(events) != 100 {
+		t.Fatalf("expected 100 events, got %d", len(events))
+	}
+	for i := 1; i < len(events); i++ {
+		if events[i].ID <= events[i-1].ID {
+			t.Fatalf("event ID %d after %d", events[i].ID, events[i-1].ID)
+		}
+	}
+
+	lp.mutex.Lock()
+	lp.deleteEvents(map[int]bool{events[0].ID: true})
+	lp.mutex.Unlock()
+	lp.NewEvent("feed1", "new")
+	stored := lp.eventStore.LoadSince("feed1", 0)
+	if len(stored) != 100 || stored[len(stored)-1].ID <= events[len(events)-1].ID || stored[len(stored)-1].Data != "new" {
+		t.Fatalf("event ID reused: %+v", stored[len(stored)-1])
+	}
+	for i, event := range stored[:99] {
+		if event.ID != events[i+1].ID || event.Data != events[i+1].Data {
+			t.Fatalf("event %d overwritten: %+v", event.ID, event)
+		}
+	}
+}
+
+func TestCloseSubscription(t *testing.T) {
+	lp := New()
+	lp.AddFeed("feed1")
+	subscriptionID := subscribe(t, lp, "feed=feed1")
+
+	done := make(chan int)
+	go func() { done <- listen(lp, "subscriptionID="+subscriptionID).Code }()
+	waitListening(t, lp, subscriptionID)
+	if err := lp.CloseSubscription(subscriptionID); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case code := <-done:
+		if code != 410 {
+			t.Fatalf("expected 410, got %d", code)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the listen request did not return")
+	}
+	if err := lp.CloseSubscription(subscriptionID); err == nil {
+		t.Fatal("closed subscription closed again")
+	}
+}
+
+func TestResubscribe(t *testing.T) {
+	lp := New()
+	lp.AddFeeds([]string{"feed1", "feed2"})
+	subscriptionID := subscribe(t, lp, "feed=feed1&feed=feed2")
+	if again := subscribe(t, lp, "feed=feed1&feed=feed2&subscriptionID="+subscriptionID); again != subscriptionID {
+		t.Fatalf("subscribing again created %s", again)
+	}
+	lp.mutex.RLock()
+	subscriptions := len(lp.globalClients)
+	lp.mutex.RUnlock()
+	if subscriptions != 1 {
+		t.Fatalf("expected 1 subscription, got %d", subscriptions)
+	}
+
+	lp.NewEvent("feed1", "dropped")
+	lp.NewEvent("feed2", "kept")
+	subscribe(t, lp, "feed=feed2&subscriptionID="+subscriptionID)
+	lp.NewEvent("feed1", "not subscribed")
+	if events := lp.DrainEvents(subscriptionID); len(events) != 1 || events[0].Data != "kept" {
+		t.Fatalf("events after replacing the feeds: %+v", events)
+	}
+
+	lp.NewEvent("feed2", "kept with keepEvents")
+	subscribe(t, lp, "feed=feed1&keepEvents=true&subscriptionID="+subscriptionID)
+	if events := lp.DrainEvents(subscriptionID); len(events) != 1 || events[0].Data != "kept with keepEvents" {
+		t.Fatalf("events with keepEvents: %+v", events)
+	}
+}
+
+func TestBroadcast(t *testing.T) {
+	lp := New()
+	lp.AddFeeds([]string{"feed1", "feed2"})
+	subscriptionIDs := []string{subscribe(t, lp, "feed=feed1"), subscribe(t, lp, "feed=feed2")}
+
+	if err := lp.Broadcast("announcement"); err != nil {
+		t.Fatal(err)
+	}
+	for _, subscriptionID := range subscriptionIDs {
+		events := decodeEvents(t, listen(lp, "subscriptionID="+subscriptionID)).Events
+		if len(events) != 1 || events[0].Data != "announcement" || events[0].Feed != "" {
+			t.Fatalf("broadcast not received by %s: %+v", subscriptionID, events)
+		}
+	}
+	replayed := decodeEvents(t, listen(lp, "subscriptionID="+subscriptionIDs[0]+"&lastEventID=0&wait=false")).Events
+	if len(replayed) != 1 || replayed[0].Data != "announcement" {
+		t.Fatalf("broadcast not replayed: %+v", replayed)
+	}
+}
+
+func TestTokenGenerator(t *testing.T) {
+	lp := New()
+	lp.AddFeed("feed1")
+	if subscriptionID := subscribe(t, lp, "feed=feed1"); len(subscriptionID) != DefaultTokenLength {
+		t.Fatalf("default token %q", subscriptionID)
+	}
+	if err := lp.SetTokenLength(0); err == nil {
+		t.Fatal("zero length accepted")
+	}
+	lp.SetTokenLength(8)
+	if subscriptionID := subscribe(t, lp, "feed=feed1"); len(subscriptionID) != 8 {
+		t.Fatalf("token of length 8: %q", subscriptionID)
+	}
+
+	next := 0
+	lp.SetTokenGenerator(func() string {
+		next = next + 1
+		return fmt.Sprintf("client-%d", next)
+	})
+	for _, expected := range []string{"client-1", "client-2"} {
+		if subscriptionID := subscribe(t, lp, "feed=feed1"); subscriptionID != expected {
+			t.Fatalf("expected %s, got %s", expected, subscriptionID)
+		}
+	}
+}
+
+func TestAbortWithQueuedEvents(t *testing.T) {
+	lp := New()
+	lp.AddFeed("feed1")
+	subscriptionID := subscribe(t, lp, "feed=feed1")
+
+	// The event is queued without notifying the pending request, so the
+	// second request aborts a request with queued events
+	first := make(chan *httptest.ResponseRecorder, 1)
+	go func() { first <- listen(lp, "subscriptionID="+subscriptionID) }()
+	waitListening(t, lp, subscriptionID)
+	lp.mutex.Lock()
+	event, _ := lp.storeEvent(Event{Feed: "feed1", Data: "queued"})
+	lp.enqueue(subscriptionID, event)
+	lp.mutex.Unlock()
+
+	second := listen(lp, "subscriptionID="+subscriptionID)
+	if w := <-first; w.Code != 204 {
+		t.Fatalf("aborted request: expected 204, got %d %s", w.Code, w.Body.String())
+	}
+	if events := decodeEvents(t, second).Events; second.Code != 200 || len(events) != 1 || events[0].Data != "queued" {
+		t.Fatalf("new request: %d %s", second.Code, second.Body.String())
+	}
+}
+
+func TestAbortInterleavedWithPublish(t *testing.T) {
+	for i := 0; i < 50; i++ {
+		lp := New()
+		lp.SetLogger(nil)
+		lp.SetTimeout(100 * time.Millisecond)
+		lp.AddFeed("feed1")
+		subscriptionID := subscribe(t, lp, "feed=feed1")
+
+		first := make(chan string, 1)
+		go func() { first <- listen(lp, "subscriptionID="+subscriptionID).Body.String() }()
+		waitListening(t, lp, subscriptionID)
+		go lp.NewEvent("feed1", "e1")
+		second := listen(lp, "subscriptionID="+subscriptionID).Body.String()
+		lp.NewEvent("feed1", "e2")
+		third := listen(lp, "subscriptionID="+subscriptionID+"&wait=false").Body.String()
+
+		delivered := <-first + second + third
+		if strings.Count(delivered, `"e1"`) != 1 || strings.Count(delivered, `"e2"`) != 1 {
+			t.Fatalf("events lost or delivered twice: %s", delivered)
+		}
+	}
+}
+
+func TestNilData(t *testing.T) {
+	lp := New()
+	lp.AddFeed("feed1")
+	subscriptionID := subscribe(t, lp, "feed=feed1")
+
+	if err := lp.NewEvent("feed1", nil); err != nil {
+		t.Fatal(err)
+	}
+	if body := listen(lp, "subscriptionID="+subscriptionID).Body.String(); strings.Contains(body, `"data":null`) == false {
+		t.Fatalf("nil data not delivered as null: %s", body)
+	}
+
+	lp.AllowNilData(false)
+	var nilPointer *int
+	for _, data := range []interface{}{nil, nilPointer, []int(nil), map[string]int(nil)} {
+		if err := lp.NewEvent("feed1", data); errors.Is(err, ErrNilData) == false {
+			t.Fatalf("nil data %#v: %v", data, err)
+		}
+	}
+	if err := lp.NewEventToFeeds([]string{"feed1"}, nil); errors.Is(err, ErrNilData) == false {
+		t.Fatalf("nil data to feeds: %v", err)
+	}
+	w := httptest.NewRecorder()
+	lp.PublishHandler(w, httptest.NewRequest("POST", "/publish", strings.NewReader(`{"feed":"feed1","data":null}`)))
+	if w.Code != 400 {
+		t.Fatalf("publish without data: expected 400, got %d", w.Code)
+	}
+}
+
+func TestGroupedEvents(t *testing.T) {
+	lp := New()
+	lp.AddFeeds([]string{"feed1", "feed2"})
+	subscriptionID := subscribe(t, lp, "feed=feed1&feed=feed2")
+	lp.NewEvent("feed1", 1)
+	lp.NewEvent("feed2", 2)
+	lp.NewEvent("feed1", 3)
+
+	var response GroupedEventResponse
+	w := listen(lp, "grouped=true&subscriptionID="+subscriptionID)
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("%s: %s", err, w.Body.String())
+	}
+	feed1, feed2 := response.Events["feed1"], response.Events["feed2"]
+	if len(feed1) != 2 || feed1[0].Data != float64(1) || feed1[1].Data != float64(3) || len(feed2) != 1 || feed2[0].Data != float64(2) {
+		t.Fatalf("events not grouped by feed: %s", w.Body.String())
+	}
+	if response.LastEventID != 3 || response.Count != 3 {
+		t.Fatalf("lastEventID %d, count %d", response.LastEventID, response.Count)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	lp := New()
+	lp.AddFeed("feed1")
+	lp.SetTimeout(50 * time.Millisecond)
+	lp.SetMinListenInterval(2500 * time.Millisecond)
+	subscriptionID := subscribe(t, lp, "feed=feed1")
+
+	w := listen(lp, "subscriptionID="+subscriptionID)
+	if w.Code != 408 || w.Header().Get("Retry-After") != "0" {
+		t.Fatalf("timeout: %d, Retry-After %q", w.Code, w.Header().Get("Retry-After"))
+	}
+	w = listen(lp, "subscriptionID="+subscriptionID)
+	if w.Code != 429 || w.Header().Get("Retry-After") != "3" {
+		t.Fatalf("too fast: %d, Retry-After %q", w.Code, w.Header().Get("Retry-After"))
+	}
+}
+
+func TestListenWithoutFeeds(t *testing.T) {
+	lp := New()
+	lp.AddFeed("feed1")
+	subscriptionID := subscribe(t, lp, "feed=feed1")
+	lp.NewEvent("feed1", "queued")
+	lp.mutex.Lock()
+	delete(lp.globalFeedToClients["feed1"], subscriptionID)
+	lp.mutex.Unlock()
+
+	w := listen(lp, "subscriptionID="+subscriptionID)
+	if events := decodeEvents(t, w).Events; w.Code != 200 || len(events) != 1 {
+		t.Fatalf("queued events of a subscription without feeds: %d %s", w.Code, w.Body.String())
+	}
+	start := time.Now()
+	if w = listen(lp, "subscriptionID="+subscriptionID); w.Code != 409 || time.Since(start) > time.Second {
+		t.Fatalf("expected an immediate 409, got %d after %s", w.Code, time.Since(start))
+	}
+}
+
+func TestSubscribeUnavailableFeed(t *testing.T) {
+	lp := New()
+	lp.SetLogger(nil)
+	lp.AddFeed("feed1")
+	w := httptest.NewRecorder()
+	lp.SubscribeHandler(w, httptest.NewRequest("GET", "/subscribe?feed=feed1&feed=unknown", nil))
+	if w.Code != 409 || lp.Stats().Clients != 0 {
+		t.Fatalf("expected 409 and no subscription, got %d and %d clients", w.Code, lp.Stats().Clients)
+	}
+
+	// A feed removed while a client subscribes: the client is subscribed to
+	// all the feeds before the removal, or to none of them.
+	for i := 0; i < 50; i++ {
+		lp := New()
+		lp.SetLogger(nil)
+		lp.AddFeed("feed1")
+		lp.AddFeed("feed2")
+		w := httptest.NewRecorder()
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			lp.SubscribeHandler(w, httptest.NewRequest("GET", "/subscribe?feed=feed1&feed=feed2", nil))
+		}()
+		go func() {
+			defer wg.Done()
+			lp.RemoveFeed("feed2")
+		}()
+		wg.Wait()
+
+		stats := lp.Stats()
+		switch w.Code {
+		case 409:
+			if stats.Clients != 0 {
+				t.Fatalf("rejected client subscribed: %+v", stats)
+			}
+		case 200:
+			if stats.Clients != 1 || stats.Feeds["feed1"] != 1 {
+				t.Fatalf("expected a client on feed1, got %+v", stats)
+			}
+		default:
+			t.Fatalf("unexpected status %d", w.Code)
+		}
+	}
+}
+
+func TestInitialDelay(t *testing.T) {
+	lp := New()
+	lp.SetLogger(nil)
+	lp.AddFeed("feed1")
+	lp.SetTimeout(time.Second)
+	lp.SetInitialDelay(50 * time.Millisecond)
+	subscriptionID := subscribe(t, lp, "feed=feed1")
+
+	start := time.Now()
+	w := listen(lp, "subscriptionID="+subscriptionID)
+	if w.Code != 200 || len(decodeEvents(t, w).Events) != 0 || time.Since(start) > 500*time.Millisecond {
+		t.Fatalf("expected an early empty response, got %d %s after %s", w.Code, w.Body.String(), time.Since(start))
+	}
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() { done <- listen(lp, "subscriptionID="+subscriptionID) }()
+	waitListening(t, lp, subscriptionID)
+	lp.NewEvent("feed1", "event1")
+	if response := decodeEvents(t, <-done); len(response.Events) != 1 {
+		t.Fatalf("expected the event before the delay, got %+v", response)
+	}
+
+	// A delay longer than the timeout has no effect
+	lp.SetInitialDelay(2 * time.Second)
+	lp.SetTimeout(50 * time.Millisecond)
+	if w := listen(lp, "subscriptionID="+subscriptionID); w.Code != 408 {
+		t.Fatalf("expected 408, got %d", w.Code)
+	}
+}
+
+func TestFlushOnAbort(t *testing.T) {
+	lp := New()
+	lp.SetLogger(nil)
+	lp.AddFeed("feed1")
+	lp.FlushOnAbort(true)
+	subscriptionID := subscribe(t, lp, "feed=feed1")
+
+	// The event is queued without notifying the pending request, so the
+	// second request aborts a request with queued events, that it flushes
+	first := make(chan *httptest.ResponseRecorder, 1)
+	go func() { first <- listen(lp, "subscriptionID="+subscriptionID) }()
+	waitListening(t, lp, subscriptionID)
+	lp.mutex.Lock()
+	event, _ := lp.storeEvent(Event{Feed: "feed1", Data: "queued"})
+	lp.enqueue(subscriptionID, event)
+	lp.mutex.Unlock()
+
+	second := make(chan *httptest.ResponseRecorder, 1)
+	go func() { second <- listen(lp, "subscriptionID="+subscriptionID) }()
+	w := <-first
+	if events := decodeEvents(t, w).Events; w.Code != 200 || len(events) != 1 || events[0].Data != "queued" {
+		t.Fatalf("aborted request: %d %s", w.Code, w.Body.String())
+	}
+	waitListening(t, lp, subscriptionID)
+	lp.NewEvent("feed1", "new")
+	w = <-second
+	if events := decodeEvents(t, w).Events; w.Code != 200 || len(events) != 1 || events[0].Data != "new" {
+		t.Fatalf("new request: %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestEventsCount(t *testing.T) {
+	lp := New()
+	lp.SetLogger(nil)
+	lp.AddFeed("feed1")
+	subscriptionID := subscribe(t, lp, "feed=feed1")
+
+	body := listen(lp, "wait=false&subscriptionID="+subscriptionID).Body.String()
+	if strings.Contains(body, `"events":[]`) == false || strings.Contains(body, `"count":0`) == false {
+		t.Fatalf("expected an empty list and a zero count, got %s", body)
+	}
+	lp.SetInitialDelay(20 * time.Millisecond)
+	body = listen(lp, "subscriptionID="+subscriptionID).Body.String()
+	if strings.Contains(body, `"events":[]`) == false || strings.Contains(body, "null") == true {
+		t.Fatalf("expected an empty list after the initial delay, got %s", body)
+	}
+
+	lp.NewEvent("feed1", "event1")
+	lp.NewEvent("feed1", "event2")
+	body = listen(lp, "grouped=true&subscriptionID="+subscriptionID).Body.String()
+	if strings.Contains(body, `"count":2`) == false {
+		t.Fatalf("expected the count of the grouped events, got %s", body)
+	}
+}
+
+func TestEventSequence(t *testing.T) {
+	lp := New()
+	lp.AddFeed("feed1")
+	subscriptionID := subscribe(t, lp, "feed=feed1")
+	other := subscribe(t, lp, "feed=feed1")
+
+	lp.NewEvent("feed1", 1)
+	lp.NewEvent("feed1", 2)
+	if events := lp.DrainEvents(subscriptionID); len(events) != 2 || events[0].Sequence != 1 || events[1].Sequence != 2 {
+		t.Fatalf("expected the sequences 1 and 2, got %+v", events)
+	}
+	lp.NewEvent("feed1", 3)
+	if events := lp.DrainEvents(subscriptionID); len(events) != 1 || events[0].Sequence != 3 {
+		t.Fatalf("expected the sequence 3, got %+v", events)
+	}
+	if events := lp.DrainEvents(other); len(events) != 3 || events[2].Sequence != 3 {
+		t.Fatalf("expected the sequences of the other subscription, got %+v", events)
+	}
+
+	// The dropped events leave a gap
+	lp.SetMaxQueueLength(1, DropOldest)
+	lp.NewEvent("feed1", 4)
+	lp.NewEvent("feed1", 5)
+	if events := lp.DrainEvents(subscriptionID); len(events) != 1 || events[0].Sequence != 5 {
+		t.Fatalf("expected the sequence 5 after the gap, got %+v", events)
+	}
+}
+
+func TestNotifyTimeout(t *testing.T) {
+	lp := New()
+	lp.SetLogger(nil)
+	lp.AddFeed("feed1")
+	lp.SetNotifyTimeout(20 * time.Millisecond)
+	subscriptionID := subscribe(t, lp, "feed=feed1")
+
+	// A queued event, and a pending connection whose channel is full and
+	// that nobody reads
+	lp.mutex.Lock()
+	event, _ := lp.storeEvent(Event{Feed: "feed1", Data: "event1"})
+	lp.enqueue(subscriptionID, event)
+	_, channel, _ := lp.openConnection(subscriptionID)
+	channel <- "ABORT"
+	lp.globalClients[subscriptionID] = true
+	lp.mutex.Unlock()
+
+	done := make(chan bool)
+	go func() { done <- lp.notifyEvent(subscriptionID) }()
+	select {
+	case notified := <-done:
+		if notified == true {
+			t.Fatal("signal reported as received")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("notifyEvent blocked after the notify timeout")
+	}
+	if info, _ := lp.GetSubscription(subscriptionID); info.Listening == false || info.QueuedEvents != 1 {
+		t.Fatalf("expected the event still queued, got %+v", info)
+	}
+	if err := lp.SetNotifyTimeout(0); err == nil {
+		t.Fatal("zero notify timeout accepted")
+	}
+}
+
+func TestBufferedSignal(t *testing.T) {
+	lp := New()
+	lp.SetLogger(nil)
+	lp.AddFeed("feed1")
+	lp.SetNotifyTimeout(20 * time.Millisecond)
+	subscriptionID := subscribe(t, lp, "feed=feed1")
+
+	// A signal sent before the request receives it is kept, without blocking
+	lp.mutex.Lock()
+	connection, channel, _ := lp.openConnection(subscriptionID)
+	lp.mutex.Unlock()
+	if lp.notify(channel, "DONE") == false {
+		t.Fatal("signal not kept by the channel")
+	}
+	if lp.notify(channel, "ABORT") == true {
+		t.Fatal("second signal kept by the channel")
+	}
+
+	// A terminated connection drops the signal left in its channel
+	lp.mutex.Lock()
+	lp.closeConnection(subscriptionID, connection)
+	_, exists := lp.globalConnectionChannel[connection]
+	lp.mutex.Unlock()
+	if exists == true {
+		t.Fatal("channel of the terminated connection not removed")
+	}
+	select {
+	case operation := <-channel:
+		t.Fatalf("signal %s not drained", operation)
+	default:
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	lp := New()
+	logger := &logRecorder{}
+	lp.SetLogger(logger)
+	lp.AddFeed("feed1")
+	lp.SetTimeout(30 * time.Millisecond)
+	subscriptionID := subscribe(t, lp, "feed=feed1")
+
+	listen(lp, "subscriptionID="+subscriptionID)
+	lp.NewEvent("feed1", 1)
+	lp.NewEvent("feed1", 2)
+	listen(lp, "subscriptionID="+subscriptionID)
+
+	lines := logger.find("listen ")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 access log lines, got %q", lines)
+	}
+	for _, field := range []string{"subscriptionID=" + subscriptionID, "outcome=timeout", "wait=", "events=0"} {
+		if strings.Contains(lines[0], field) == false {
+			t.Fatalf("%s missing in %q", field, lines[0])
+		}
+	}
+	for _, field := range []string{"outcome=delivered", "events=2"} {
+		if strings.Contains(lines[1], field) == false {
+			t.Fatalf("%s missing in %q", field, lines[1])
+		}
+	}
+}
+
+// stuckConnection opens a pending connection whose channel is full and that
+// nobody reads, so notifying the subscription blocks
+func stuckConnection(lp *LongPoll, subscriptionID string) {
+	lp.mutex.Lock()
+	defer lp.mutex.Unlock()
+	_, channel, _ := lp.openConnection(subscriptionID)
+	channel <- "ABORT"
+	lp.globalClients[subscriptionID] = true
+}
+
+func TestNewEventSync(t *testing.T) {
+	lp := New()
+	lp.SetLogger(nil)
+	lp.AddFeed("feed1")
+	broker := &recordingBroker{}
+	lp.UseBroker(broker)
+	subscriptionID := subscribe(t, lp, "feed=feed1")
+
+	go func() {
+		waitListening(t, lp, subscriptionID)
+		lp.NewEventSync("feed1", "event1", time.Second)
+	}()
+	if events := decodeEvents(t, listen(lp, "subscriptionID="+subscriptionID)).Events; len(events) != 1 {
+		t.Fatalf("expected the event delivered, got %+v", events)
+	}
+
+	// The event is shared also if the timeout elapses
+	stuckConnection(lp, subscriptionID)
+	if _, err := lp.NewEventSync("feed1", "event2", 20*time.Millisecond); err == nil {
+		t.Fatal("expected the timeout error")
+	}
+	if events := broker.events(); len(events) != 2 || events[1].Data != "event2" {
+		t.Fatalf("expected the event shared after the timeout, got %+v", events)
+	}
+}
+
+func TestNewEventContext(t *testing.T) {
+	lp := New()
+	lp.SetLogger(nil)
+	lp.AddFeed("feed1")
+	broker := &recordingBroker{}
+	lp.UseBroker(broker)
+	subscriptionID := subscribe(t, lp, "feed=feed1")
+
+	// The event is shared also if the context is done
+	stuckConnection(lp, subscriptionID)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := lp.NewEventContext(ctx, "feed1", "event1"); err != context.DeadlineExceeded {
+		t.Fatalf("expected the context error, got %v", err)
+	}
+	if events := broker.events(); len(events) != 1 || events[0].Data != "event1" {
+		t.Fatalf("expected the event shared after the context is done, got %+v", events)
+	}
+}
@@ -0,0 +1,40 @@
+package longpolltest_test
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/frncscsrcc/longpoll"
+	"github.com/frncscsrcc/longpoll/longpolltest"
+)
+
+func Example() {
+	lp := longpoll.New()
+	lp.SetLogger(nil)
+	lp.AddFeeds([]string{"chat", "news"})
+	server := longpolltest.NewServer(lp)
+	defer server.Close()
+
+	client := longpolltest.NewClient(server.URL)
+	if err := client.Subscribe("chat"); err != nil {
+		fmt.Println(err)
+		return
+	}
+	client.Publish("chat", map[string]string{"text": "hello"})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	event, err := client.WaitForEvent(ctx, "chat")
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	fmt.Println(event.Feed, event.Data)
+
+	err = client.Publish("sports", "goal")
+	fmt.Println(err)
+	// Output:
+	// chat map[text:hello]
+	// status 409: FEED_NOT_AVAILABLE Feed sports is not available
+}
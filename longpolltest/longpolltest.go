@@ -0,0 +1,201 @@
+// Package longpolltest provides a server and a client to write integration
+// tests against a longpoll.LongPoll instance, without building the requests
+// and parsing the responses by hand.
+//
+//	func TestChat(t *testing.T) {
+//		lp := longpoll.New()
+//		lp.AddFeed("chat")
+//		server := longpolltest.NewServer(lp)
+//		defer server.Close()
+//
+//		client := longpolltest.NewClient(server.URL)
+//		if err := client.Subscribe("chat"); err != nil {
+//			t.Fatal(err)
+//		}
+//		lp.NewEvent("chat", "hello")
+//
+//		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+//		defer cancel()
+//		event, err := client.WaitForEvent(ctx, "chat")
+//		if err != nil || event.Data != "hello" {
+//			t.Fatal(event, err)
+//		}
+//	}
+package longpolltest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+
+	"github.com/frncscsrcc/longpoll"
+)
+
+// NewServer starts a test server that exposes the handlers of lp at the paths
+// /subscribe, /listen, /unsubscribe and /publish. It must be closed at the
+// end of the test.
+func NewServer(lp *longpoll.LongPoll) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/subscribe", lp.SubscribeHandler)
+	mux.HandleFunc("/listen", lp.ListenHandler)
+	mux.HandleFunc("/unsubscribe", lp.UnsubscribeHandler)
+	mux.HandleFunc("/publish", lp.PublishHandler)
+	return httptest.NewServer(mux)
+}
+
+// TestClient is a client of a server started with NewServer. It is not safe
+// for concurrent use.
+type TestClient struct {
+	// BaseURL is the URL of the server
+	BaseURL string
+	// HTTPClient sends the requests
+	HTTPClient *http.Client
+	// SubscriptionID is set by Subscribe
+	SubscriptionID string
+	// LastEventID is the highest event ID received so far
+	LastEventID int
+	// received contains the events received but not returned yet by
+	// WaitForEvent
+	received []longpoll.Event
+}
+
+// NewClient is the constructor, it returns a pointer to a TestClient of the
+// server at baseURL
+func NewClient(baseURL string) *TestClient {
+	return &TestClient{
+		BaseURL:    baseURL,
+		HTTPClient: http.DefaultClient,
+	}
+}
+
+// Subscribe subscribes the client to the feeds. The first call creates the
+// subscription, the following ones replace its feeds.
+func (tc *TestClient) Subscribe(feeds ...string) error {
+	query := url.Values{"feed": feeds}
+	if tc.SubscriptionID != "" {
+		query.Set("subscriptionID", tc.SubscriptionID)
+	}
+
+	var response longpoll.SubscriptionResponse
+	if err := tc.get(context.Background(), "/subscribe", query, &response); err != nil {
+		return err
+	}
+	tc.SubscriptionID = response.SubscriptionID
+	return nil
+}
+
+// Unsubscribe removes the client from the feeds, or from all its feeds if
+// none is passed
+func (tc *TestClient) Unsubscribe(feeds ...string) error {
+	query := url.Values{"subscriptionID": {tc.SubscriptionID}, "feed": feeds}
+	return tc.get(context.Background(), "/unsubscribe", query, nil)
+}
+
+// Listen sends a listen request, and returns the received events. If the
+// request times out, it returns no events and no error.
+func (tc *TestClient) Listen(ctx context.Context) ([]longpoll.Event, error) {
+	query := url.Values{"subscriptionID": {tc.SubscriptionID}}
+
+	var response longpoll.EventResponse
+	err := tc.get(ctx, "/listen", query, &response)
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusRequestTimeout {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if response.LastEventID > tc.LastEventID {
+		tc.LastEventID = response.LastEventID
+	}
+	return response.Events, nil
+}
+
+// WaitForEvent listens until an event of the feed is received, and returns
+// it. An empty feed matches any event. The events of the other feeds are
+// discarded, while the following events of the same response are returned by
+// the next calls.
+func (tc *TestClient) WaitForEvent(ctx context.Context, feed string) (longpoll.Event, error) {
+	for {
+		for len(tc.received) > 0 {
+			event := tc.received[0]
+			tc.received = tc.received[1:]
+			if feed == "" || event.Feed == feed {
+				return event, nil
+			}
+		}
+
+		events, err := tc.Listen(ctx)
+		if err != nil {
+			return longpoll.Event{}, err
+		}
+		tc.received = append(tc.received, events...)
+	}
+}
+
+// Publish publishes an event through the publish end-point
+func (tc *TestClient) Publish(feed string, data interface{}) error {
+	encodedData, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(map[string]interface{}{"feed": feed, "data": json.RawMessage(encodedData)})
+	if err != nil {
+		return err
+	}
+
+	request, err := http.NewRequest(http.MethodPost, tc.BaseURL+"/publish", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	return tc.do(request, nil)
+}
+
+// StatusError is returned when the server responds with an error
+type StatusError struct {
+	StatusCode int
+	Code       longpoll.ErrorCode
+	Message    string
+}
+
+func (e *StatusError) Error() string {
+	return "status " + strconv.Itoa(e.StatusCode) + ": " + string(e.Code) + " " + e.Message
+}
+
+// get sends a GET request, and decodes the response in v (if not nil)
+func (tc *TestClient) get(ctx context.Context, path string, query url.Values, v interface{}) error {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, tc.BaseURL+path+"?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	return tc.do(request, v)
+}
+
+// do sends a request, and decodes the response in v (if not nil)
+func (tc *TestClient) do(request *http.Request, v interface{}) error {
+	response, err := tc.HTTPClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode >= 300 {
+		var errorResponse longpoll.ErrorResponse
+		json.NewDecoder(response.Body).Decode(&errorResponse)
+		return &StatusError{response.StatusCode, errorResponse.Error.Code, errorResponse.Error.Message}
+	}
+	if v == nil || response.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	if err := json.NewDecoder(response.Body).Decode(v); err != nil {
+		return fmt.Errorf("can not decode the response: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package longpoll
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// listenWaitBuckets are the upper bounds, in seconds, of the buckets of the
+// listen wait histogram
+var listenWaitBuckets = []float64{0.1, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// histogram counts the observed values in cumulative buckets, as in the
+// Prometheus histograms
+type histogram struct {
+	counts []int
+	sum    float64
+	count  int
+}
+
+// observe records a value
+func (h *histogram) observe(value float64) {
+	if h.counts == nil {
+		h.counts = make([]int, len(listenWaitBuckets))
+	}
+	for i, bound := range listenWaitBuckets {
+		if value <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += value
+	h.count++
+}
+
+// observeListen records how long a listen request waited
+func (lp *LongPoll) observeListen(start time.Time) {
+	lp.mutex.Lock()
+	lp.listenWaits.observe(lp.clock.Now().Sub(start).Seconds())
+	lp.mutex.Unlock()
+}
+
+// MetricsHandler responds with the metrics in the Prometheus text exposition
+// format, so they can be scraped without depending on the Prometheus client
+// library:
+//   - longpoll_events_published_total: the published events
+//   - longpoll_events_delivered_total: the events sent to the clients
+//   - longpoll_subscriptions: the current subscriptions
+//   - longpoll_connections: the open listen connections and streams
+//   - longpoll_listen_wait_seconds: a histogram of the listen durations
+func (lp *LongPoll) MetricsHandler(w http.ResponseWriter, r *http.Request) {
+	lp.mutex.RLock()
+	published := lp.publishedEvents
+	delivered := lp.deliveredEvents
+	subscriptions := len(lp.globalClients)
+	connections := len(lp.globalClientToConnection)
+	listenWaits := lp.listenWaits
+	listenWaits.counts = append([]int(nil), lp.listenWaits.counts...)
+	lp.mutex.RUnlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.WriteHeader(http.StatusOK)
+
+	writeMetric(w, "longpoll_events_published_total", "counter", "Number of published events.", published)
+	writeMetric(w, "longpoll_events_delivered_total", "counter", "Number of events sent to the clients.", delivered)
+	writeMetric(w, "longpoll_subscriptions", "gauge", "Number of subscriptions.", subscriptions)
+	writeMetric(w, "longpoll_connections", "gauge", "Number of open listen connections and streams.", connections)
+
+	fmt.Fprintln(w, "# HELP longpoll_listen_wait_seconds Duration of the listen requests.")
+	fmt.Fprintln(w, "# TYPE longpoll_listen_wait_seconds histogram")
+	for i, bound := range listenWaitBuckets {
+		count := 0
+		if listenWaits.counts != nil {
+			count = listenWaits.counts[i]
+		}
+		fmt.Fprintf(w, "longpoll_listen_wait_seconds_bucket{le=\"%s\"} %d\n", strconv.FormatFloat(bound, 'g', -1, 64), count)
+	}
+	fmt.Fprintf(w, "longpoll_listen_wait_seconds_bucket{le=\"+Inf\"} %d\n", listenWaits.count)
+	fmt.Fprintf(w, "longpoll_listen_wait_seconds_sum %s\n", strconv.FormatFloat(listenWaits.sum, 'g', -1, 64))
+	fmt.Fprintf(w, "longpoll_listen_wait_seconds_count %d\n", listenWaits.count)
+}
+
+// writeMetric writes a metric with a single value
+func writeMetric(w io.Writer, name string, metricType string, help string, value int) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", name, help, name, metricType, name, value)
+}
@@ -0,0 +1,77 @@
+package longpoll
+
+import (
+	"context"
+	"net/http"
+	"strings"
+)
+
+// Headers read by the handlers (the session ID only by WithContext). The
+// names of the subscriptionID and of the feeds headers can be changed with
+// SetSubscriptionIDHeader and SetFeedsHeader.
+const (
+	SubscriptionIDHeader = "X-Subscription-ID"
+	FeedsHeader          = "X-Feeds"
+	SessionIDHeader      = "X-Session-ID"
+)
+
+// RequestIDHeader is the header with the ID of a request. The handlers send
+// it back in the response, generating a new ID if the request has none, and
+// they add it to their log lines.
+const RequestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength is the maximum length of an ID passed by a client, the
+// longer ones are replaced
+const maxRequestIDLength = 128
+
+// NewContext returns a copy of ctx that carries contextStruct: the handlers
+// use its SubscriptionID and its Feeds before looking in the request body and
+// in the query-string.
+func NewContext(ctx context.Context, contextStruct ContextStruct) context.Context {
+	return context.WithValue(ctx, ContextStructIdentifier, contextStruct)
+}
+
+// WithContext is a middleware that fills the ContextStruct of the request with
+// the headers X-Subscription-ID, X-Feeds (a comma separated list) and
+// X-Session-ID, so they are available to the following middlewares (the
+// handlers read the subscriptionID and the feeds headers anyway). It is not
+// bound to a LongPoll, so it always reads the default header names. The fields
+// already set by a previous middleware are kept. For example:
+//
+//	http.HandleFunc("/listen", longpoll.WithContext(lp.ListenHandler))
+func WithContext(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		contextStruct, _ := r.Context().Value(ContextStructIdentifier).(ContextStruct)
+
+		if contextStruct.SubscriptionID == "" {
+			contextStruct.SubscriptionID = strings.TrimSpace(r.Header.Get(SubscriptionIDHeader))
+		}
+		if len(contextStruct.Feeds) == 0 {
+			contextStruct.Feeds = splitFeeds(r.Header.Get(FeedsHeader))
+		}
+		if contextStruct.SessionID == "" {
+			contextStruct.SessionID = strings.TrimSpace(r.Header.Get(SessionIDHeader))
+		}
+
+		next(w, r.WithContext(NewContext(r.Context(), contextStruct)))
+	}
+}
+
+// SetSubscriptionIDHeader changes the name of the header with the
+// subscriptionID (by default X-Subscription-ID), read by the handlers and sent
+// back by SubscribeAndListenHandler, for example when a proxy in front of the
+// server already uses it. It should be called before serving requests.
+func (lp *LongPoll) SetSubscriptionIDHeader(name string) {
+	lp.mutex.Lock()
+	lp.subscriptionIDHeader = name
+	lp.mutex.Unlock()
+}
+
+// SetFeedsHeader changes the name of the header with the comma separated list
+// of feeds (by default X-Feeds) read by the handlers. It should be called
+// before serving requests.
+func (lp *LongPoll) SetFeedsHeader(name string) {
+	lp.mutex.Lock()
+	lp.feedsHeader = name
+	lp.mutex.Unlock()
+}
@@ -0,0 +1,20 @@
+// Package msgpack implements a longpoll.Serializer that encodes the responses
+// as MessagePack, usually smaller than JSON.
+//
+//	lp := longpoll.New()
+//	lp.AddSerializer(msgpack.MediaType, msgpack.Serializer{})
+package msgpack
+
+import "github.com/vmihailenco/msgpack/v5"
+
+// MediaType is the media type of the MessagePack responses
+const MediaType = "application/msgpack"
+
+// Serializer encodes the responses as MessagePack
+type Serializer struct{}
+
+// Marshal encodes v as MessagePack
+func (Serializer) Marshal(v interface{}) ([]byte, string, error) {
+	content, err := msgpack.Marshal(v)
+	return content, MediaType, err
+}
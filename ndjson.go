@@ -0,0 +1,73 @@
+package longpoll
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http"
+)
+
+// StreamHandler streams the events of a subscription as newline-delimited
+// JSON (application/x-ndjson): like SSEHandler the connection is kept open,
+// but every event is written as a JSON object on its own line, without the
+// SSE framing. It expects the same subscriptionID used by ListenHandler, and
+// the stream is closed in the same cases as the SSE one. With
+// SendReadyFrame, the first line is the ReadyFrame.
+func (lp *LongPoll) StreamHandler(w http.ResponseWriter, r *http.Request) {
+	requestID := getRequestID(w, r)
+
+	flusher, ok := w.(http.Flusher)
+	if ok == false {
+		sendError(w, 500, ErrorStreamingUnsupported, "Streaming not supported")
+		return
+	}
+
+	stream, err := lp.OpenStream(r)
+	if err != nil {
+		WriteError(w, err)
+		return
+	}
+	defer stream.Close()
+	subscriptionID := stream.SubscriptionID()
+
+	var out io.Writer = w
+	flush := flusher.Flush
+	if lp.mustCompress(r) {
+		compressor := gzip.NewWriter(w)
+		defer compressor.Close()
+		out = compressor
+		flush = func() {
+			compressor.Flush()
+			flusher.Flush()
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Add("Vary", "Accept-Encoding")
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flush()
+
+	lp.logger.Printf("Client %s (%d) opened a stream [%s]\n", subscriptionID, stream.connection, requestID)
+
+	// The encoder terminates every object with a newline
+	encoder := json.NewEncoder(out)
+	if ready, ok := stream.Ready(); ok == true {
+		encoder.Encode(ready)
+		flush()
+	}
+	for {
+		events, err := stream.Next(r.Context())
+		if err != nil {
+			lp.logger.Printf("Stream %s (%d) closed: %s [%s]\n", subscriptionID, stream.connection, err, requestID)
+			return
+		}
+		for _, event := range events {
+			if err := encoder.Encode(event); err != nil {
+				lp.logger.Printf("Can not encode event %d for %s: %s [%s]\n", event.ID, subscriptionID, err, requestID)
+			}
+		}
+		flush()
+	}
+}
@@ -0,0 +1,43 @@
+package longpoll
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+)
+
+func TestStreamHandler(t *testing.T) {
+	lp := New()
+	lp.AddFeed("feed1")
+	subscriptionID := subscribe(t, lp, "feed=feed1")
+	server := httptest.NewServer(http.HandlerFunc(lp.StreamHandler))
+	defer server.Close()
+
+	response, err := http.Get(server.URL + "?subscriptionID=" + subscriptionID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	if contentType := response.Header.Get("Content-Type"); contentType != "application/x-ndjson" {
+		t.Fatalf("content type %q", contentType)
+	}
+	for lp.ActiveConnections() == 0 {
+		runtime.Gosched()
+	}
+	lp.NewEvent("feed1", "a")
+	lp.NewEvent("feed1", "b")
+
+	scanner := bufio.NewScanner(response.Body)
+	for _, expected := range []string{"a", "b"} {
+		if scanner.Scan() == false {
+			t.Fatal(scanner.Err())
+		}
+		var event Event
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil || event.Data != expected {
+			t.Fatalf("expected %s, got %s (%v)", expected, scanner.Text(), err)
+		}
+	}
+}
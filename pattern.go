@@ -0,0 +1,78 @@
+package longpoll
+
+import "strings"
+
+// patternWildcard ends a feed pattern: a client subscribed to "user.123.*"
+// receives the events of every feed starting with "user.123."
+const patternWildcard = "*"
+
+// isPattern checks if a feed passed by a client is a pattern
+func isPattern(feed string) bool {
+	return strings.Contains(feed, patternWildcard)
+}
+
+// isValidPattern checks that the wildcard appears only at the end of the
+// pattern
+func isValidPattern(pattern string) bool {
+	return strings.Index(pattern, patternWildcard) == len(pattern)-len(patternWildcard)
+}
+
+// matchPattern checks if a feed matches a pattern
+func matchPattern(pattern string, feed string) bool {
+	return strings.HasPrefix(feed, strings.TrimSuffix(pattern, patternWildcard))
+}
+
+// feedClients returns the clients that receive the events of a feed, because
+// they subscribed to it or to a matching pattern. It must be called holding
+// the lock.
+func (lp *LongPoll) feedClients(feed string) clientExist {
+	// Patterns are evaluated only if some client subscribed to one
+	if len(lp.globalPatternToClients) == 0 {
+		return lp.globalFeedToClients[feed]
+	}
+	clients := make(clientExist)
+	for client := range lp.globalFeedToClients[feed] {
+		clients[client] = true
+	}
+	for pattern, patternClients := range lp.globalPatternToClients {
+		if matchPattern(pattern, feed) == false {
+			continue
+		}
+		for client := range patternClients {
+			clients[client] = true
+		}
+	}
+	return clients
+}
+
+// receivesEvent checks if a client receives an event, because it is subscribed
+// to one of its feeds (or the event is a broadcast) and the event passes its
+// filter. It must be called holding the lock.
+func (lp *LongPoll) receivesEvent(subscriptionID string, event Event) bool {
+	if filter, ok := lp.globalClientToFilter[subscriptionID]; ok == true && filter(event) == false {
+		return false
+	}
+	if event.isBroadcast() == true {
+		return true
+	}
+	for _, feed := range event.allFeeds() {
+		if lp.isSubscribed(subscriptionID, feed) {
+			return true
+		}
+	}
+	return false
+}
+
+// isSubscribed checks if a client receives the events of a feed. It must be
+// called holding the lock.
+func (lp *LongPoll) isSubscribed(subscriptionID string, feed string) bool {
+	if lp.globalFeedToClients[feed][subscriptionID] == true {
+		return true
+	}
+	for pattern, patternClients := range lp.globalPatternToClients {
+		if patternClients[subscriptionID] == true && matchPattern(pattern, feed) {
+			return true
+		}
+	}
+	return false
+}
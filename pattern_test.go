@@ -0,0 +1,36 @@
+package longpoll
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPatternSubscription(t *testing.T) {
+	lp := New()
+	lp.AddFeeds([]string{"user.1.messages", "user.1.alerts", "user.2.messages"})
+	subscriptionID := subscribe(t, lp, "feed=user.1.*")
+
+	lp.NewEvent("user.1.messages", "message")
+	lp.NewEvent("user.2.messages", "not matching")
+	lp.NewEvent("user.1.alerts", "alert")
+
+	events := decodeEvents(t, listen(lp, "subscriptionID="+subscriptionID)).Events
+	if len(events) != 2 || events[0].Data != "message" || events[1].Data != "alert" {
+		t.Fatalf("expected the events of user.1.*, got %+v", events)
+	}
+}
+
+func TestInvalidPattern(t *testing.T) {
+	lp := New()
+	lp.AddFeed("user.1.messages")
+	for _, pattern := range []string{"user.*.messages", "*.messages"} {
+		w := httptest.NewRecorder()
+		lp.SubscribeHandler(w, httptest.NewRequest("GET", "/subscribe?feed="+pattern, nil))
+		if w.Code != 400 {
+			t.Fatalf("pattern %s: expected 400, got %d", pattern, w.Code)
+		}
+	}
+	if matchPattern("user.1.*", "user.10.messages") == true {
+		t.Fatal("user.10.messages matches user.1.*")
+	}
+}
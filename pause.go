@@ -0,0 +1,39 @@
+package longpoll
+
+import "errors"
+
+// PauseSubscription pauses the delivery of the events to a subscription, for
+// example while the client app is in background: the events are queued, but
+// a pending listen request is not woken up, and the new ones wait (or, with
+// wait=false, respond with an empty list) until the subscription is resumed.
+// It returns an error if the subscription does not exist.
+func (lp *LongPoll) PauseSubscription(subscriptionID string) error {
+	lp.mutex.Lock()
+	defer lp.mutex.Unlock()
+
+	if _, clientExists := lp.globalClients[subscriptionID]; clientExists == false {
+		return errors.New("subscription " + subscriptionID + " does not exist")
+	}
+	lp.globalClientToPaused[subscriptionID] = true
+	return nil
+}
+
+// ResumeSubscription resumes the delivery of the events to a paused
+// subscription: a pending listen request receives at once all the events
+// queued in the meantime. It returns an error if the subscription does not
+// exist.
+func (lp *LongPoll) ResumeSubscription(subscriptionID string) error {
+	lp.mutex.Lock()
+	if _, clientExists := lp.globalClients[subscriptionID]; clientExists == false {
+		lp.mutex.Unlock()
+		return errors.New("subscription " + subscriptionID + " does not exist")
+	}
+	delete(lp.globalClientToPaused, subscriptionID)
+	mustNotify := lp.hasEvents(subscriptionID)
+	lp.mutex.Unlock()
+
+	if mustNotify == true {
+		go lp.notifyEvent(subscriptionID)
+	}
+	return nil
+}
@@ -0,0 +1,39 @@
+package longpoll
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestPauseSubscription(t *testing.T) {
+	lp := New()
+	lp.SetLogger(nil)
+	lp.AddFeed("feed1")
+	subscriptionID := subscribe(t, lp, "feed=feed1")
+	lp.PauseSubscription(subscriptionID)
+
+	done := make(chan *httptest.ResponseRecorder, 1)
+	go func() { done <- listen(lp, "subscriptionID="+subscriptionID) }()
+	waitListening(t, lp, subscriptionID)
+	lp.NewEvent("feed1", "event1")
+	lp.NewEvent("feed1", "event2")
+	select {
+	case w := <-done:
+		t.Fatalf("paused subscription woken up: %s", w.Body.String())
+	case <-time.After(100 * time.Millisecond):
+	}
+	if info, _ := lp.GetSubscription(subscriptionID); info.QueuedEvents != 2 || info.Paused == false {
+		t.Fatalf("expected 2 queued events while paused, got %+v", info)
+	}
+
+	lp.ResumeSubscription(subscriptionID)
+	select {
+	case w := <-done:
+		if response := decodeEvents(t, w); len(response.Events) != 2 {
+			t.Fatalf("expected the 2 queued events, got %+v", response)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("subscription not woken up after the resume")
+	}
+}
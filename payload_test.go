@@ -0,0 +1,38 @@
+package longpoll
+
+import (
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMaxPayloadSize(t *testing.T) {
+	lp := New()
+	lp.SetLogger(nil)
+	lp.AddFeed("feed1")
+	lp.SetMaxPayloadSize(10)
+	// A string of 8 characters is encoded in 10 bytes, with the quotes
+	if err := lp.NewEvent("feed1", strings.Repeat("x", 8)); err != nil {
+		t.Fatalf("event within the limit rejected: %s", err)
+	}
+	if err := lp.NewEvent("feed1", strings.Repeat("x", 9)); errors.Is(err, ErrPayloadTooLarge) == false {
+		t.Fatalf("expected ErrPayloadTooLarge, got %v", err)
+	}
+	subscriptionID := subscribe(t, lp, "feed=feed1")
+	if err := lp.NewEventForClient(subscriptionID, "feed1", strings.Repeat("x", 9)); errors.Is(err, ErrPayloadTooLarge) == false {
+		t.Fatalf("expected ErrPayloadTooLarge for the client event, got %v", err)
+	}
+
+	for body, code := range map[string]int{
+		`{"feed":"feed1","data":"xxx"}`:                                        204,
+		`{"feed":"feed1","data":"xxxxxxxxxxxx"}`:                               413,
+		`{"feed":"feed1","data":"` + strings.Repeat("x", envelopeSlack) + `"}`: 413,
+	} {
+		w := httptest.NewRecorder()
+		lp.PublishHandler(w, httptest.NewRequest("POST", "/publish", strings.NewReader(body)))
+		if w.Code != code {
+			t.Fatalf("publish of %d bytes: expected %d, got %d", len(body), code, w.Code)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package longpoll
+
+import "sort"
+
+// PresenceInfo describes a client that is online
+type PresenceInfo struct {
+	// SubscriptionID identifies the subscription
+	SubscriptionID string `json:"subscriptionId"`
+	// Name is the display name passed by the client when it subscribed, or
+	// empty
+	Name string `json:"name"`
+}
+
+// Presence returns the clients subscribed to a feed (directly or with a
+// pattern) that have an open connection (a listen request or a stream),
+// sorted by name. A client that polls is online while its listen request is
+// pending, so it is missing from the list for the short time between two
+// requests. It is safe to call it concurrently with the handlers.
+func (lp *LongPoll) Presence(feed string) []PresenceInfo {
+	lp.mutex.RLock()
+	defer lp.mutex.RUnlock()
+
+	presence := make([]PresenceInfo, 0)
+	for client := range lp.feedClients(feed) {
+		if _, hasConnection := lp.globalClientToConnection[client]; hasConnection == true {
+			presence = append(presence, PresenceInfo{client, lp.globalClientToName[client]})
+		}
+	}
+	sort.Slice(presence, func(i, j int) bool {
+		if presence[i].Name != presence[j].Name {
+			return presence[i].Name < presence[j].Name
+		}
+		return presence[i].SubscriptionID < presence[j].SubscriptionID
+	})
+	return presence
+}
+
+// setClientName sets the display name of a client, or removes it if name is
+// empty. It must be called holding the lock.
+func (lp *LongPoll) setClientName(subscriptionID string, name string) {
+	if name == "" {
+		delete(lp.globalClientToName, subscriptionID)
+		return
+	}
+	lp.globalClientToName[subscriptionID] = name
+}
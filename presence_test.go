@@ -0,0 +1,30 @@
+package longpoll
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPresence(t *testing.T) {
+	lp := New()
+	lp.AddFeed("room")
+	alice := subscribe(t, lp, "feed=room&name=alice")
+	subscribe(t, lp, "feed=room&name=bob")
+	if presence := lp.Presence("room"); len(presence) != 0 {
+		t.Fatalf("expected nobody connected, got %+v", presence)
+	}
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() { done <- listen(lp, "subscriptionID="+alice) }()
+	waitListening(t, lp, alice)
+	presence := lp.Presence("room")
+	if len(presence) != 1 || presence[0].Name != "alice" || presence[0].SubscriptionID != alice {
+		t.Fatalf("expected alice connected, got %+v", presence)
+	}
+
+	lp.NewEvent("room", "hello")
+	<-done
+	if presence := lp.Presence("room"); len(presence) != 0 {
+		t.Fatalf("expected nobody connected after the response, got %+v", presence)
+	}
+}
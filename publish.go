@@ -0,0 +1,112 @@
+package longpoll
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// PublishAuthorizer is an Authorizer that checks also the publish requests
+type PublishAuthorizer interface {
+	Authorizer
+	// CanPublish checks if the request can publish an event on the feed.
+	// Errors are handled as in CanSubscribe.
+	CanPublish(r *http.Request, feed string) error
+}
+
+// envelopeSlack is the room left in a publish request body for the fields
+// other than the data, when the max payload size is set
+const envelopeSlack = 4096
+
+// publishBody is the JSON body of a publish request
+type publishBody struct {
+	Feed string          `json:"feed"`
+	Data json.RawMessage `json:"data"`
+}
+
+// PublishHandler handles the publish requests. It expects a POST with a JSON
+// body like {"feed": "feed1", "data": {...}}, and publishes the data as with
+// NewEvent: the data is delivered as it was sent, as a RawData, and the
+// event keeps the ID of the request (see X-Request-ID). If the
+// Authorizer is a PublishAuthorizer it is consulted before publishing, so the
+// handler should not be exposed publicly without one. It could respond with:
+//   - 204: The event was published.
+//   - 400: Missing feed, invalid body, or missing data (if the nil data are
+//     not allowed, see AllowNilData).
+//   - 401, 403: The Authorizer rejected the request.
+//   - 405: The method is not POST.
+//   - 409: The feed is not available.
+//   - 413: The data exceeds the size set with SetMaxPayloadSize. A body
+//     larger than the max payload size (plus some room for the feed) is not
+//     even read.
+func (lp *LongPoll) PublishHandler(w http.ResponseWriter, r *http.Request) {
+	requestID := getRequestID(w, r)
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		sendError(w, 405, ErrorMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	lp.mutex.RLock()
+	maxPayloadSize := lp.maxPayloadSize
+	lp.mutex.RUnlock()
+	if maxPayloadSize > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, int64(maxPayloadSize+envelopeSlack))
+	}
+
+	var body publishBody
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		var maxBytesError *http.MaxBytesError
+		if errors.As(err, &maxBytesError) {
+			sendError(w, 413, ErrorPayloadTooLarge, "Payload too large")
+			return
+		}
+		sendError(w, 400, ErrorInvalidBody, "Invalid body")
+		return
+	}
+	if body.Feed == "" {
+		sendError(w, 400, ErrorMissingFeed, "Missing feed")
+		return
+	}
+
+	if err := lp.authorizePublish(r, body.Feed); err != nil {
+		sendAuthError(w, err)
+		return
+	}
+
+	// A missing or null data is a nil data, that can be rejected
+	event := Event{Feed: body.Feed, RequestID: requestID}
+	if len(body.Data) > 0 && string(body.Data) != "null" {
+		event.Data = RawData{"application/json", body.Data}
+	}
+	err := lp.publishEvent(event)
+	if errors.Is(err, ErrNilData) {
+		sendError(w, 400, ErrorInvalidBody, "Missing data")
+		return
+	}
+	if errors.Is(err, ErrPayloadTooLarge) {
+		sendError(w, 413, ErrorPayloadTooLarge, "Payload too large")
+		return
+	}
+	if err != nil {
+		lp.logger.Printf("Can not publish on %s: %s [%s]\n", body.Feed, err, requestID)
+		sendError(w, 409, ErrorFeedNotAvailable, fmt.Sprintf("Feed %s is not available", body.Feed))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// authorizePublish consults the Authorizer, if it is a PublishAuthorizer, for
+// a publish request
+func (lp *LongPoll) authorizePublish(r *http.Request, feed string) error {
+	lp.mutex.RLock()
+	authorizer, ok := lp.authorizer.(PublishAuthorizer)
+	lp.mutex.RUnlock()
+
+	if ok == false {
+		return nil
+	}
+	return authorizer.CanPublish(r, feed)
+}
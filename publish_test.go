@@ -0,0 +1,42 @@
+package longpoll
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPublishHandler(t *testing.T) {
+	lp := New()
+	lp.AddFeed("feed1")
+	subscriptionID := subscribe(t, lp, "feed=feed1")
+
+	done := make(chan string)
+	go func() { done <- listen(lp, "subscriptionID="+subscriptionID).Body.String() }()
+	waitListening(t, lp, subscriptionID)
+	w := httptest.NewRecorder()
+	lp.PublishHandler(w, httptest.NewRequest("POST", "/publish", strings.NewReader(`{"feed":"feed1","data":{"x":1}}`)))
+	if w.Code != 204 {
+		t.Fatalf("publish: %d %s", w.Code, w.Body.String())
+	}
+	if body := <-done; strings.Contains(body, `"data":{"x":1}`) == false {
+		t.Fatalf("event not received: %s", body)
+	}
+
+	for body, code := range map[string]int{
+		`{"feed":"unknown","data":1}`: 409,
+		`{"data":1}`:                  400,
+		`{"feed":`:                    400,
+	} {
+		w = httptest.NewRecorder()
+		lp.PublishHandler(w, httptest.NewRequest("POST", "/publish", strings.NewReader(body)))
+		if w.Code != code {
+			t.Fatalf("publish %s: expected %d, got %d", body, code, w.Code)
+		}
+	}
+	w = httptest.NewRecorder()
+	lp.PublishHandler(w, httptest.NewRequest("GET", "/publish", nil))
+	if w.Code != 405 {
+		t.Fatalf("GET: expected 405, got %d", w.Code)
+	}
+}
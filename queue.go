@@ -0,0 +1,89 @@
+package longpoll
+
+import "errors"
+
+// OverflowPolicy decides which event is dropped when a new event is queued
+// for a client whose queue is full
+type OverflowPolicy int
+
+// Overflow policies
+const (
+	// DropOldest removes the oldest queued event to make room for the new one
+	DropOldest OverflowPolicy = iota
+	// DropNewest discards the new event, keeping the queued ones
+	DropNewest
+)
+
+// SetMaxQueueLength limits the number of events queued for every client (for
+// example a client that subscribed but stopped listening): when the queue is
+// full, a new event is handled with the overflow policy. Zero (the default)
+// means no limit. The limit applies to the new events, not to the ones
+// queued again with lastEventID or backlog.
+func (lp *LongPoll) SetMaxQueueLength(maxQueueLength int, policy OverflowPolicy) error {
+	if maxQueueLength < 0 {
+		return errors.New("max queue length must not be negative")
+	}
+	if policy != DropOldest && policy != DropNewest {
+		return errors.New("unknown overflow policy")
+	}
+	lp.mutex.Lock()
+	lp.maxQueueLength = maxQueueLength
+	lp.overflowPolicy = policy
+	lp.mutex.Unlock()
+	return nil
+}
+
+// OnOverflow sets a callback called after a publication that dropped events
+// because some queues were full, once for every subscription that lost
+// events, with the number of dropped events. It can be used to log or to
+// alert on the slow consumers. The callback is called in its own goroutine,
+// so it can block and call the LongPoll methods. A nil callback (the default)
+// disables it.
+func (lp *LongPoll) OnOverflow(handler func(subscriptionID string, dropped int)) {
+	lp.mutex.Lock()
+	lp.overflowHandler = handler
+	lp.mutex.Unlock()
+}
+
+// enqueue appends an event to the queue of a client, if it passes the filter
+// of the client, applying the overflow policy if the queue is full: the
+// dropped events skip their Sequence numbers, so the client sees the gap. It
+// reports if the event was queued. It must be called holding the lock.
+func (lp *LongPoll) enqueue(subscriptionID string, event Event) bool {
+	if filter, ok := lp.globalClientToFilter[subscriptionID]; ok == true && filter(event) == false {
+		return false
+	}
+
+	queue := lp.globalClientToNewEvents[subscriptionID]
+	if lp.maxQueueLength > 0 && len(queue) >= lp.maxQueueLength {
+		if lp.overflowPolicy == DropNewest {
+			lp.overflows[subscriptionID] = lp.overflows[subscriptionID] + 1
+			lp.globalClientToSequence[subscriptionID] = lp.globalClientToSequence[subscriptionID] + 1
+			return false
+		}
+		dropped := len(queue) - lp.maxQueueLength + 1
+		lp.overflows[subscriptionID] = lp.overflows[subscriptionID] + dropped
+		lp.globalClientToSequence[subscriptionID] = lp.globalClientToSequence[subscriptionID] + dropped
+		queue = queue[dropped:]
+	}
+	lp.globalClientToNewEvents[subscriptionID] = append(queue, event.ID)
+	return true
+}
+
+// reportOverflows passes to the OnOverflow callback the events dropped since
+// the last call, and forgets them. It is called at the end of every
+// publication. It must be called holding the lock.
+func (lp *LongPoll) reportOverflows() {
+	if len(lp.overflows) == 0 {
+		return
+	}
+	overflows := lp.overflows
+	lp.overflows = make(map[string]int)
+	if handler := lp.overflowHandler; handler != nil {
+		go func() {
+			for subscriptionID, dropped := range overflows {
+				handler(subscriptionID, dropped)
+			}
+		}()
+	}
+}
@@ -0,0 +1,65 @@
+package longpoll
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMaxQueueLength(t *testing.T) {
+	for policy, expected := range map[OverflowPolicy][]int{
+		DropOldest: {2, 3, 4},
+		DropNewest: {0, 1, 2},
+	} {
+		lp := New()
+		lp.AddFeed("feed1")
+		lp.SetMaxQueueLength(3, policy)
+		subscriptionID := subscribe(t, lp, "feed=feed1")
+		for i := 0; i < 5; i++ {
+			lp.NewEvent("feed1", i)
+		}
+
+		events := lp.DrainEvents(subscriptionID)
+		if len(events) != len(expected) {
+			t.Fatalf("policy %d: expected %v, got %+v", policy, expected, events)
+		}
+		for i, event := range events {
+			if event.Data != expected[i] {
+				t.Fatalf("policy %d: expected %v, got %+v", policy, expected, events)
+			}
+		}
+	}
+
+	lp := New()
+	if err := lp.SetMaxQueueLength(-1, DropOldest); err == nil {
+		t.Fatal("negative length accepted")
+	}
+	if err := lp.SetMaxQueueLength(1, OverflowPolicy(5)); err == nil {
+		t.Fatal("unknown policy accepted")
+	}
+}
+
+func TestOnOverflow(t *testing.T) {
+	lp := New()
+	lp.AddFeed("feed1")
+	lp.SetMaxQueueLength(2, DropOldest)
+	overflows := make(chan int, 10)
+	lp.OnOverflow(func(subscriptionID string, dropped int) { overflows <- dropped })
+	subscribe(t, lp, "feed=feed1")
+
+	lp.NewEvent("feed1", 1)
+	lp.NewEvent("feed1", 2)
+	lp.NewEvents([]FeedEvent{{"feed1", 3}, {"feed1", 4}})
+	select {
+	case dropped := <-overflows:
+		if dropped != 2 {
+			t.Fatalf("expected 2 dropped events, got %d", dropped)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("callback not called")
+	}
+	select {
+	case dropped := <-overflows:
+		t.Fatalf("callback called again with %d", dropped)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
@@ -0,0 +1,51 @@
+package longpoll
+
+import (
+	"encoding/json"
+	"errors"
+	"mime"
+	"strings"
+)
+
+// RawData is the payload of an event published with NewRawEvent: the body is
+// already encoded, and it is delivered without being encoded again. A JSON
+// body (with a content type like application/json or application/*+json) is
+// embedded as it is in the responses (the JSON encoder only removes its
+// insignificant whitespace); any other body is sent as
+// {"contentType": "...", "body": "..."}, with the body encoded in base64, so
+// the client gets back exactly the same bytes.
+type RawData struct {
+	ContentType string
+	Body        []byte
+}
+
+// MarshalJSON embeds the body in the JSON responses without encoding it again
+func (raw RawData) MarshalJSON() ([]byte, error) {
+	if isJSONContentType(raw.ContentType) {
+		return raw.Body, nil
+	}
+	return json.Marshal(struct {
+		ContentType string `json:"contentType"`
+		Body        []byte `json:"body"`
+	}{raw.ContentType, raw.Body})
+}
+
+// NewRawEvent publishes an event whose payload is already encoded, for
+// example a protobuf message. The body must not be modified after the call.
+// It returns an error if the feed does not exist, or if the content type is
+// JSON but the body is not valid JSON.
+func (lp *LongPoll) NewRawEvent(feed string, body []byte, contentType string) error {
+	if isJSONContentType(contentType) && json.Valid(body) == false {
+		return errors.New("body is not valid JSON")
+	}
+	return lp.NewEvent(feed, RawData{contentType, body})
+}
+
+// isJSONContentType checks if a content type is JSON
+func isJSONContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
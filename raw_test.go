@@ -0,0 +1,41 @@
+package longpoll
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+func TestNewRawEvent(t *testing.T) {
+	lp := New()
+	lp.AddFeed("feed1")
+	subscriptionID := subscribe(t, lp, "feed=feed1")
+	binary := []byte{0, 1, 2, 255}
+
+	if err := lp.NewRawEvent("feed1", []byte("{"), "application/json"); err == nil {
+		t.Fatal("invalid JSON body published")
+	}
+	lp.NewRawEvent("feed1", []byte(`{"b":[1,2.50],"a":"\u00e8"}`), "application/json")
+	lp.NewRawEvent("feed1", binary, "application/x-protobuf")
+
+	body := listen(lp, "subscriptionID="+subscriptionID).Body.Bytes()
+	if bytes.Contains(body, []byte(`"data":{"b":[1,2.50],"a":"\u00e8"}`)) == false {
+		t.Fatalf("JSON body encoded again: %s", body)
+	}
+	var response struct {
+		Events []struct {
+			Data json.RawMessage `json:"data"`
+		} `json:"events"`
+	}
+	json.Unmarshal(body, &response)
+	var raw struct {
+		ContentType string `json:"contentType"`
+		Body        []byte `json:"body"`
+	}
+	if len(response.Events) != 2 || json.Unmarshal(response.Events[1].Data, &raw) != nil {
+		t.Fatalf("unexpected response: %s", body)
+	}
+	if raw.ContentType != "application/x-protobuf" || bytes.Equal(raw.Body, binary) == false {
+		t.Fatalf("binary body changed: %+v", raw)
+	}
+}
@@ -0,0 +1,92 @@
+// Package redisbroker implements a longpoll.Broker that shares the events
+// among more instances through a Redis pub/sub channel.
+//
+//	lp := longpoll.New()
+//	lp.UseBroker(redisbroker.New("localhost:6379", "longpoll"))
+package redisbroker
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+
+	"github.com/frncscsrcc/longpoll"
+	"github.com/redis/go-redis/v9"
+)
+
+// message is the payload published on the Redis channel
+type message struct {
+	Origin string
+	Event  longpoll.Event
+}
+
+// Broker publishes and receives the events on a Redis channel
+type Broker struct {
+	client  *redis.Client
+	channel string
+	// origin identifies this instance, to skip its own messages
+	origin string
+	pubsub *redis.PubSub
+}
+
+// New is the constructor, it returns a pointer to a Broker connected to the
+// Redis server at addr, that uses the passed channel
+func New(addr string, channel string) *Broker {
+	return NewWithClient(redis.NewClient(&redis.Options{Addr: addr}), channel)
+}
+
+// NewWithClient returns a pointer to a Broker that uses an existing Redis
+// client
+func NewWithClient(client *redis.Client, channel string) *Broker {
+	origin := make([]byte, 16)
+	rand.Read(origin)
+	return &Broker{
+		client:  client,
+		channel: channel,
+		origin:  hex.EncodeToString(origin),
+	}
+}
+
+// Publish sends an event to the other instances
+func (b *Broker) Publish(event longpoll.Event) error {
+	payload, err := json.Marshal(message{b.origin, event})
+	if err != nil {
+		return err
+	}
+	return b.client.Publish(context.Background(), b.channel, payload).Err()
+}
+
+// Subscribe registers the function that receives the events published by
+// the other instances
+func (b *Broker) Subscribe(receive func(event longpoll.Event)) error {
+	ctx := context.Background()
+	b.pubsub = b.client.Subscribe(ctx, b.channel)
+	if _, err := b.pubsub.Receive(ctx); err != nil {
+		b.pubsub.Close()
+		return err
+	}
+
+	go func() {
+		for redisMessage := range b.pubsub.Channel() {
+			var received message
+			if err := json.Unmarshal([]byte(redisMessage.Payload), &received); err != nil {
+				continue
+			}
+			// Events published by this instance were already delivered
+			if received.Origin == b.origin {
+				continue
+			}
+			receive(received.Event)
+		}
+	}()
+	return nil
+}
+
+// Close stops receiving the events and closes the Redis client
+func (b *Broker) Close() error {
+	if b.pubsub != nil {
+		b.pubsub.Close()
+	}
+	return b.client.Close()
+}
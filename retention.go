@@ -0,0 +1,77 @@
+package longpoll
+
+import (
+	"errors"
+	"sort"
+)
+
+// SetMaxRetainedEvents limits the number of retained events, to bound the
+// memory on the bursty feeds: when a new event exceeds the limit, the oldest
+// one is evicted, and it is removed also from the client queues, even if some
+// client did not receive it yet (the clients see the gap in the Sequence of
+// their events). A client replaying with a lastEventID older than an evicted
+// event receives 410 (Events not available), as for the expired events. Zero
+// (the default) means no limit.
+func (lp *LongPoll) SetMaxRetainedEvents(maxRetainedEvents int) error {
+	if maxRetainedEvents < 0 {
+		return errors.New("max retained events must not be negative")
+	}
+	lp.mutex.Lock()
+	defer lp.mutex.Unlock()
+
+	lp.maxRetainedEvents = maxRetainedEvents
+	lp.retainedEvents = nil
+	if maxRetainedEvents == 0 {
+		return nil
+	}
+	for _, event := range lp.eventStore.LoadSince("", 0) {
+		lp.retainedEvents = append(lp.retainedEvents, event.ID)
+	}
+	lp.evictEvents()
+	return nil
+}
+
+// retainEvent records a new event, and evicts the oldest ones if the limit of
+// the retained events is exceeded. It must be called holding the lock.
+func (lp *LongPoll) retainEvent(eventID int) {
+	if lp.maxRetainedEvents == 0 {
+		return
+	}
+	lp.retainedEvents = append(lp.retainedEvents, eventID)
+	lp.evictEvents()
+}
+
+// evictEvents deletes the oldest events exceeding the limit of the retained
+// events. They are the oldest events of the store, so they are found at the
+// head of the sorted client queues, without walking them. It must be called
+// holding the lock.
+func (lp *LongPoll) evictEvents() {
+	exceeding := len(lp.retainedEvents) - lp.maxRetainedEvents
+	if exceeding <= 0 {
+		return
+	}
+	evicted := lp.retainedEvents[:exceeding]
+	lastEvicted := evicted[len(evicted)-1]
+	if lastEvicted > lp.globalLastExpiredEvent {
+		lp.globalLastExpiredEvent = lastEvicted
+	}
+	lp.eventStore.Delete(evicted)
+	lp.retainedEvents = lp.retainedEvents[exceeding:]
+
+	for client, queue := range lp.globalClientToNewEvents {
+		if skipped := sort.SearchInts(queue, lastEvicted+1); skipped > 0 {
+			lp.globalClientToSequence[client] = lp.globalClientToSequence[client] + skipped
+			lp.globalClientToNewEvents[client] = queue[skipped:]
+		}
+	}
+	// The in-flight events are not sorted, but there are few of them
+	for client, queue := range lp.globalClientToInFlight {
+		pending := make([]int, 0, len(queue))
+		for _, eventID := range queue {
+			if eventID > lastEvicted {
+				pending = append(pending, eventID)
+			}
+		}
+		lp.globalClientToInFlight[client] = pending
+	}
+}
@@ -0,0 +1,56 @@
+package longpoll
+
+import "testing"
+
+func TestMaxRetainedEvents(t *testing.T) {
+	lp := New()
+	lp.SetLogger(nil)
+	lp.AddFeed("feed1")
+	subscriptionID := subscribe(t, lp, "feed=feed1")
+	for i := 1; i <= 5; i++ {
+		lp.NewEvent("feed1", i)
+	}
+	if err := lp.SetMaxRetainedEvents(10); err != nil {
+		t.Fatalf("SetMaxRetainedEvents: %s", err)
+	}
+	for i := 6; i <= 10; i++ {
+		lp.NewEvent("feed1", i)
+	}
+	if stored := lp.eventStore.LoadSince("", 0); len(stored) != 10 {
+		t.Fatalf("expected 10 events within the limit, got %d", len(stored))
+	}
+
+	// Over the limit, only the oldest event is evicted
+	lp.NewEvent("feed1", 11)
+	stored := lp.eventStore.LoadSince("", 0)
+	if len(stored) != 10 || stored[0].ID != 2 || stored[9].ID != 11 {
+		t.Fatalf("expected the events from 2 to 11, got %+v", stored)
+	}
+	events := lp.DrainEvents(subscriptionID)
+	if len(events) != 10 || events[0].ID != 2 || events[0].Sequence != 2 {
+		t.Fatalf("expected the queue from the event 2, got %+v", events)
+	}
+	lp.NewEvent("feed1", 12)
+	stored = lp.eventStore.LoadSince("", 0)
+	if len(stored) != 10 || stored[0].ID != 3 {
+		t.Fatalf("expected the events from 3 to 12, got %+v", stored)
+	}
+	if events := lp.DrainEvents(subscriptionID); len(events) != 1 || events[0].ID != 12 || events[0].Sequence != 12 {
+		t.Fatalf("expected the event 12, got %+v", events)
+	}
+
+	if w := listen(lp, "wait=false&lastEventID=1&subscriptionID="+subscriptionID); w.Code != 410 {
+		t.Fatalf("replay from an evicted event: expected 410, got %d", w.Code)
+	}
+	if w := listen(lp, "wait=false&lastEventID=2&subscriptionID="+subscriptionID); w.Code != 200 {
+		t.Fatalf("replay from the last evicted event: expected 200, got %d", w.Code)
+	}
+	lp.SetMaxRetainedEvents(1)
+	lp.NewEvent("feed1", 13)
+	if stored := lp.eventStore.LoadSince("", 0); len(stored) != 1 || stored[0].Data != 13 {
+		t.Fatalf("expected only the newest event, got %+v", stored)
+	}
+	if err := lp.SetMaxRetainedEvents(-1); err == nil {
+		t.Fatal("negative limit accepted")
+	}
+}
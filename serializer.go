@@ -0,0 +1,72 @@
+package longpoll
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// Serializer encodes the responses sent to the clients
+type Serializer interface {
+	// Marshal encodes v, and returns the encoded content with its content
+	// type
+	Marshal(v interface{}) ([]byte, string, error)
+}
+
+// JSONSerializer is the default Serializer, it encodes the responses as JSON
+type JSONSerializer struct{}
+
+// Marshal encodes v as JSON
+func (JSONSerializer) Marshal(v interface{}) ([]byte, string, error) {
+	content, err := json.Marshal(v)
+	return content, "application/json", err
+}
+
+// AddSerializer registers a Serializer for a media type. A client that lists
+// the media type in its Accept header receives the responses encoded by this
+// Serializer; the others receive JSON.
+func (lp *LongPoll) AddSerializer(mediaType string, serializer Serializer) {
+	lp.mutex.Lock()
+	lp.serializers[mediaType] = serializer
+	lp.mutex.Unlock()
+}
+
+// serializerFor returns the Serializer for the media types accepted by the
+// client, in order of preference, or the JSON one
+func (lp *LongPoll) serializerFor(r *http.Request) Serializer {
+	lp.mutex.RLock()
+	defer lp.mutex.RUnlock()
+
+	for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType := strings.TrimSpace(strings.SplitN(accepted, ";", 2)[0])
+		if serializer, ok := lp.serializers[mediaType]; ok == true {
+			return serializer
+		}
+	}
+	return JSONSerializer{}
+}
+
+// sendResponse sends v to the client, encoded with the Serializer chosen for
+// the request, and compressed if the client accepts it. A response whose
+// headers were already sent by the heartbeats can not be compressed.
+func (lp *LongPoll) sendResponse(w http.ResponseWriter, r *http.Request, v interface{}) {
+	content, contentType, err := lp.serializerFor(r).Marshal(lp.legacyResponse(v))
+	if err != nil {
+		lp.logger.Printf("Can not encode the response: %s\n", err)
+		sendError(w, 500, ErrorEncodingFailed, "Can not encode the response")
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+
+	heartbeat, isHeartbeat := w.(*heartbeatWriter)
+	if len(content) >= minCompressionSize && lp.mustCompress(r) &&
+		(isHeartbeat == false || heartbeat.headerSent() == false) {
+		if compressed, err := gzipContent(content); err == nil {
+			content = compressed
+			w.Header().Set("Content-Encoding", "gzip")
+			w.Header().Add("Vary", "Accept-Encoding")
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(content)
+}
@@ -0,0 +1,109 @@
+package longpoll
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// SSEHandler streams the events of a subscription as Server-Sent Events. It
+// expects the same subscriptionID used by ListenHandler, but the connection
+// is kept open and every event is written as soon as it is published, as a
+// frame with the event ID and the JSON encoded event as data. A browser that
+// reconnects sends the Last-Event-ID header, and receives first the events it
+// missed in the meantime, then the new ones. The stream is closed when the
+// client disconnects, when a new listen request comes for the same
+// subscription, when the client unsubscribes and at the shutdown. With
+// SendReadyFrame, the first frame is a "ready" event, with the ReadyFrame as
+// data.
+func (lp *LongPoll) SSEHandler(w http.ResponseWriter, r *http.Request) {
+	requestID := getRequestID(w, r)
+
+	flusher, ok := w.(http.Flusher)
+	if ok == false {
+		sendError(w, 500, ErrorStreamingUnsupported, "Streaming not supported")
+		return
+	}
+
+	stream, err := lp.OpenStream(r)
+	if err != nil {
+		WriteError(w, err)
+		return
+	}
+	defer stream.Close()
+	subscriptionID := stream.SubscriptionID()
+
+	lp.mutex.RLock()
+	heartbeatInterval := lp.heartbeatInterval
+	lp.mutex.RUnlock()
+
+	// A compressed stream must be flushed by the gzip writer first, or the
+	// frames would be delayed until enough content is buffered
+	var out io.Writer = w
+	flush := flusher.Flush
+	if lp.mustCompress(r) {
+		compressor := gzip.NewWriter(w)
+		defer compressor.Close()
+		out = compressor
+		flush = func() {
+			compressor.Flush()
+			flusher.Flush()
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Add("Vary", "Accept-Encoding")
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flush()
+
+	lp.logger.Printf("Client %s (%d) opened a stream [%s]\n", subscriptionID, stream.connection, requestID)
+
+	if ready, ok := stream.Ready(); ok == true {
+		data, _ := json.Marshal(ready)
+		fmt.Fprintf(out, "event: ready\ndata: %s\n\n", data)
+		flush()
+	}
+
+	for {
+		// Without heartbeats, the stream waits until the client disconnects
+		ctx, cancel := context.WithCancel(r.Context())
+		if heartbeatInterval > 0 {
+			go func() {
+				select {
+				case <-lp.clock.After(heartbeatInterval):
+					cancel()
+				case <-ctx.Done():
+				}
+			}()
+		}
+		events, err := stream.Next(ctx)
+		cancel()
+
+		if errors.Is(err, context.Canceled) && r.Context().Err() == nil {
+			fmt.Fprint(out, ": heartbeat\n\n")
+			flush()
+			continue
+		}
+		if err != nil {
+			lp.logger.Printf("Stream %s (%d) closed: %s [%s]\n", subscriptionID, stream.connection, err, requestID)
+			return
+		}
+
+		for _, event := range events {
+			data, err := json.Marshal(event)
+			if err != nil {
+				lp.logger.Printf("Can not encode event %d for %s: %s [%s]\n", event.ID, subscriptionID, err, requestID)
+				continue
+			}
+			fmt.Fprintf(out, "id: %d\ndata: %s\n\n", event.ID, data)
+		}
+		flush()
+	}
+}
@@ -0,0 +1,55 @@
+package longpoll
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// readSSEField reads the stream until n lines with the field are received, and
+// returns their values
+func readSSEField(t *testing.T, reader *bufio.Reader, field string, n int) []string {
+	t.Helper()
+	values := make([]string, 0, n)
+	for len(values) < n {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.HasPrefix(line, field+":") {
+			values = append(values, strings.TrimSpace(strings.TrimPrefix(line, field+":")))
+		}
+	}
+	return values
+}
+
+func TestSSELastEventID(t *testing.T) {
+	lp := New()
+	lp.AddFeed("feed1")
+	subscriptionID := subscribe(t, lp, "feed=feed1")
+	for i := 0; i < 3; i++ {
+		lp.NewEvent("feed1", i)
+	}
+	lp.DrainEvents(subscriptionID)
+	server := httptest.NewServer(http.HandlerFunc(lp.SSEHandler))
+	defer server.Close()
+
+	request, _ := http.NewRequest("GET", server.URL+"?subscriptionID="+subscriptionID, nil)
+	request.Header.Set("Last-Event-ID", "1")
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	reader := bufio.NewReader(response.Body)
+
+	if ids := readSSEField(t, reader, "id", 2); strings.Join(ids, ",") != "2,3" {
+		t.Fatalf("expected the missed events 2 and 3, got %v", ids)
+	}
+	lp.NewEvent("feed1", 3)
+	if ids := readSSEField(t, reader, "id", 1); ids[0] != "4" {
+		t.Fatalf("expected the new event 4, got %v", ids)
+	}
+}
@@ -0,0 +1,186 @@
+package longpoll
+
+import (
+	"net/http"
+	"sort"
+	"time"
+)
+
+// Stats is a snapshot of the state of a LongPoll instance
+type Stats struct {
+	// Clients is the number of subscribed clients
+	Clients int
+	// PendingConnections is the number of listen requests waiting for events
+	PendingConnections int
+	// PublishedEvents is the number of events published since the start
+	PublishedEvents int
+	// Feeds contains the number of subscribed clients for every feed
+	Feeds map[string]int
+	// MaxDeliveryLag is the highest DeliveryLag among the subscriptions
+	MaxDeliveryLag time.Duration
+}
+
+// Stats returns a snapshot of the current state. It is safe to call it
+// concurrently with the handlers.
+func (lp *LongPoll) Stats() Stats {
+	lp.mutex.RLock()
+	defer lp.mutex.RUnlock()
+
+	stats := Stats{
+		Clients:         len(lp.globalClients),
+		PublishedEvents: lp.publishedEvents,
+		Feeds:           make(map[string]int),
+	}
+	for _, pending := range lp.globalClients {
+		if pending == true {
+			stats.PendingConnections++
+		}
+	}
+	for feed, clients := range lp.globalFeedToClients {
+		stats.Feeds[feed] = len(clients)
+	}
+	now := lp.clock.Now()
+	for client := range lp.globalClients {
+		if lag := lp.deliveryLag(client, now); lag > stats.MaxDeliveryLag {
+			stats.MaxDeliveryLag = lag
+		}
+	}
+	return stats
+}
+
+// StatsHandler responds with the current Stats
+func (lp *LongPoll) StatsHandler(w http.ResponseWriter, r *http.Request) {
+	lp.sendResponse(w, r, lp.Stats())
+}
+
+// ActiveConnections returns the number of open connections (listen requests
+// and streams). Unlike the number of clients, it does not count the idle
+// subscriptions, so it can be used as an autoscaling signal. It is safe to
+// call it concurrently with the handlers.
+func (lp *LongPoll) ActiveConnections() int {
+	lp.mutex.RLock()
+	defer lp.mutex.RUnlock()
+
+	return len(lp.globalClientToConnection)
+}
+
+// ActiveConnectionsByFeed returns the number of open connections for every
+// feed (or pattern) with at least one of them: a connection counts for all
+// the feeds of its subscription. It is safe to call it concurrently with the
+// handlers.
+func (lp *LongPoll) ActiveConnectionsByFeed() map[string]int {
+	lp.mutex.RLock()
+	defer lp.mutex.RUnlock()
+
+	connections := make(map[string]int)
+	for client := range lp.globalClientToConnection {
+		for _, feed := range lp.clientFeeds(client) {
+			connections[feed] = connections[feed] + 1
+		}
+	}
+	return connections
+}
+
+// SubscriptionInfo is a snapshot of the state of a single subscription
+type SubscriptionInfo struct {
+	// SubscriptionID identifies the subscription
+	SubscriptionID string
+	// Feeds contains the feeds (and the patterns) the client is subscribed to
+	Feeds []string
+	// QueuedEvents is the number of events waiting to be delivered
+	QueuedEvents int
+	// InFlightEvents is the number of delivered events waiting for the
+	// acknowledgment (only in ack mode)
+	InFlightEvents int
+	// DeliveryLag is the age of the oldest event waiting to be delivered, or
+	// zero if the queue is empty
+	DeliveryLag time.Duration
+	// Listening is true if the client has a pending listen request
+	Listening bool
+	// Paused is true if the delivery is paused (see PauseSubscription)
+	Paused bool
+	// LastActivity is the time of the last listen request of the client, or
+	// of its subscription
+	LastActivity time.Time
+}
+
+// GetSubscription returns the state of a subscription, and false if the
+// subscription does not exist. It is safe to call it concurrently with the
+// handlers.
+func (lp *LongPoll) GetSubscription(subscriptionID string) (SubscriptionInfo, bool) {
+	lp.mutex.RLock()
+	defer lp.mutex.RUnlock()
+
+	pending, exists := lp.globalClients[subscriptionID]
+	if exists == false {
+		return SubscriptionInfo{}, false
+	}
+	return SubscriptionInfo{
+		SubscriptionID: subscriptionID,
+		Feeds:          lp.clientFeeds(subscriptionID),
+		QueuedEvents:   len(lp.globalClientToNewEvents[subscriptionID]),
+		InFlightEvents: len(lp.globalClientToInFlight[subscriptionID]),
+		DeliveryLag:    lp.deliveryLag(subscriptionID, lp.clock.Now()),
+		Listening:      pending,
+		Paused:         lp.globalClientToPaused[subscriptionID],
+		LastActivity:   lp.globalClientToActivity[subscriptionID],
+	}, true
+}
+
+// ListSubscriptions returns the IDs of all the subscriptions, sorted. It is
+// meant for the admin and debug tools, and it is safe to call it
+// concurrently with the handlers.
+func (lp *LongPoll) ListSubscriptions() []string {
+	return lp.ListSubscriptionsAfter("", 0)
+}
+
+// ListSubscriptionsAfter returns a page of the sorted subscription IDs: at
+// most limit IDs (all of them if limit is zero) following after. The next
+// page starts after the last ID of the previous one, for example:
+//
+//	page := lp.ListSubscriptionsAfter("", 100)
+//	next := lp.ListSubscriptionsAfter(page[len(page)-1], 100)
+func (lp *LongPoll) ListSubscriptionsAfter(after string, limit int) []string {
+	lp.mutex.RLock()
+	subscriptions := make([]string, 0, len(lp.globalClients))
+	for client := range lp.globalClients {
+		if client > after {
+			subscriptions = append(subscriptions, client)
+		}
+	}
+	lp.mutex.RUnlock()
+
+	sort.Strings(subscriptions)
+	if limit > 0 && len(subscriptions) > limit {
+		subscriptions = subscriptions[:limit]
+	}
+	return subscriptions
+}
+
+// DrainEvents returns the events queued for a subscription, and removes them
+// from its queue, as a listen request would do (in ack mode they wait for the
+// acknowledgment). It returns an empty list if the subscription does not
+// exist, or if it is paused. It is meant for the tests and for the inspection
+// of the queues, and it is safe to call it concurrently with the handlers.
+func (lp *LongPoll) DrainEvents(subscriptionID string) []Event {
+	lp.mutex.Lock()
+	defer lp.mutex.Unlock()
+
+	if _, exists := lp.globalClients[subscriptionID]; exists == false {
+		return make([]Event, 0)
+	}
+	events, _ := lp.fetchEvents(subscriptionID, false, 0)
+	return events
+}
+
+// deliveryLag returns the age of the oldest event queued for a client. The
+// queue is sorted, so only its first available event is loaded. It must be
+// called holding the lock.
+func (lp *LongPoll) deliveryLag(subscriptionID string, now time.Time) time.Duration {
+	for _, eventID := range lp.globalClientToNewEvents[subscriptionID] {
+		if event, exists := lp.eventStore.Load(eventID); exists == true {
+			return now.Sub(time.UnixMilli(event.Timestamp))
+		}
+	}
+	return 0
+}
@@ -0,0 +1,77 @@
+package longpoll
+
+import (
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestDrainEvents(t *testing.T) {
+	lp := New()
+	lp.AddFeed("feed1")
+	subscriptionID := subscribe(t, lp, "feed=feed1")
+	lp.NewEvent("feed1", 1)
+	lp.NewEvent("feed1", 2)
+
+	if events := lp.DrainEvents(subscriptionID); len(events) != 2 || events[0].Data != 1 || events[1].Data != 2 {
+		t.Fatalf("first drain: %+v", events)
+	}
+	if events := lp.DrainEvents(subscriptionID); len(events) != 0 {
+		t.Fatalf("second drain: %+v", events)
+	}
+	if events := lp.DrainEvents("unknown"); events == nil || len(events) != 0 {
+		t.Fatalf("unknown subscription: %+v", events)
+	}
+}
+
+func TestActiveConnections(t *testing.T) {
+	lp := New()
+	lp.AddFeeds([]string{"feed1", "feed2"})
+	bothFeeds := subscribe(t, lp, "feed=feed1&feed=feed2")
+	onlyFeed2 := subscribe(t, lp, "feed=feed2")
+	subscribe(t, lp, "feed=feed1")
+
+	var wg sync.WaitGroup
+	for _, subscriptionID := range []string{bothFeeds, onlyFeed2} {
+		wg.Add(1)
+		go func(subscriptionID string) {
+			defer wg.Done()
+			listen(lp, "subscriptionID="+subscriptionID)
+		}(subscriptionID)
+		waitListening(t, lp, subscriptionID)
+	}
+	if connections := lp.ActiveConnections(); connections != 2 {
+		t.Fatalf("expected 2 connections, got %d", connections)
+	}
+	if byFeed := lp.ActiveConnectionsByFeed(); len(byFeed) != 2 || byFeed["feed1"] != 1 || byFeed["feed2"] != 2 {
+		t.Fatalf("connections by feed: %v", byFeed)
+	}
+
+	lp.Broadcast("release")
+	wg.Wait()
+	if connections := lp.ActiveConnections(); connections != 0 {
+		t.Fatalf("expected no connections, got %d", connections)
+	}
+}
+
+func TestListSubscriptions(t *testing.T) {
+	lp := New()
+	lp.AddFeed("feed1")
+	if subscriptionIDs := lp.ListSubscriptions(); len(subscriptionIDs) != 0 {
+		t.Fatalf("expected no subscriptions, got %v", subscriptionIDs)
+	}
+	for _, subscriptionID := range []string{"c", "a", "b"} {
+		subscribe(t, lp, "feed=feed1&subscriptionID="+subscriptionID)
+	}
+	if subscriptionIDs := lp.ListSubscriptions(); strings.Join(subscriptionIDs, ",") != "a,b,c" {
+		t.Fatalf("expected the sorted subscriptions, got %v", subscriptionIDs)
+	}
+	if page := lp.ListSubscriptionsAfter("a", 1); len(page) != 1 || page[0] != "b" {
+		t.Fatalf("expected the page after a, got %v", page)
+	}
+
+	lp.Unsubscribe("b", nil)
+	if subscriptionIDs := lp.ListSubscriptions(); strings.Join(subscriptionIDs, ",") != "a,c" {
+		t.Fatalf("expected the remaining subscriptions, got %v", subscriptionIDs)
+	}
+}
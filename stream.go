@@ -0,0 +1,185 @@
+package longpoll
+
+import (
+	"context"
+	"net/http"
+)
+
+// Errors returned by OpenStream, by Stream.Next and by Listen. They can be
+// sent to the client with WriteError.
+var (
+	ErrMissingSubscriptionID = &Error{400, ErrorMissingSubscriptionID, "Missing subscriptionID"}
+	ErrUnknownSubscription   = &Error{401, ErrorUnknownSubscription, "Unauthorized"}
+	ErrServiceUnavailable    = &Error{503, ErrorServiceUnavailable, "Service unavailable"}
+	ErrTooManyConnections    = &Error{503, ErrorTooManyConnections, "Too many connections"}
+	ErrSubscriptionRemoved   = &Error{410, ErrorSubscriptionRemoved, "Subscription removed"}
+	ErrConnectionAborted     = &Error{204, ErrorConnectionAborted, "Connection aborted"}
+	ErrEventsNotAvailable    = &Error{410, ErrorEventsNotAvailable, "Events not available"}
+	ErrRequestTimeout        = &Error{408, ErrorRequestTimeout, "Request timeout"}
+)
+
+// Stream delivers the events of a subscription over a long-lived connection,
+// like the SSE stream. It is the building block of the transports that keep
+// the connection open (see the websocket package): it counts as the open
+// connection of the subscription, so a new listen request or stream for the
+// same subscription terminates it.
+type Stream struct {
+	lp                  *LongPoll
+	subscriptionID      string
+	connection          int
+	comunicationChannel chan string
+	resend              bool
+	ready               bool
+}
+
+// ReadyFrame is the first message of a stream, if SendReadyFrame is enabled.
+// Type is always "ready", so the clients can tell it from the events.
+type ReadyFrame struct {
+	Type           string `json:"type"`
+	SubscriptionID string `json:"subscriptionId"`
+}
+
+// OpenStream opens a Stream for the subscription of the request. The
+// subscriptionID is searched as in ListenHandler, and the Authorizer is
+// consulted if it is a ListenAuthorizer. As in ListenHandler, the events
+// following the lastEventID (or the Last-Event-ID header) are delivered
+// again, before the new ones. The Stream must be closed when the client goes
+// away.
+func (lp *LongPoll) OpenStream(r *http.Request) (*Stream, error) {
+	r = withBody(r)
+	subscriptionID := lp.getSubscriptionID(r)
+	if subscriptionID == "" {
+		return nil, ErrMissingSubscriptionID
+	}
+
+	if err := lp.authorizeListen(r, subscriptionID); err != nil {
+		return nil, authError(err)
+	}
+
+	lastEventID, replay := getLastEventID(r)
+	return lp.openStream(subscriptionID, lastEventID, replay)
+}
+
+// openStream opens a Stream for a subscription, as described in OpenStream.
+// If replay is true, the events following lastEventID are delivered again.
+func (lp *LongPoll) openStream(subscriptionID string, lastEventID int, replay bool) (*Stream, error) {
+	lp.mutex.Lock()
+
+	// Check if subscriptionID exists
+	if _, clientExists := lp.globalClients[subscriptionID]; clientExists == false {
+		lp.mutex.Unlock()
+		return nil, ErrUnknownSubscription
+	}
+
+	if lp.shutdown == true {
+		lp.mutex.Unlock()
+		return nil, ErrServiceUnavailable
+	}
+
+	if replay == true {
+		if lastEventID < lp.globalLastExpiredEvent {
+			lp.mutex.Unlock()
+			return nil, ErrEventsNotAvailable
+		}
+		lp.replayEvents(subscriptionID, lastEventID)
+	}
+
+	if lp.connectionsLimitReached(subscriptionID) {
+		lp.mutex.Unlock()
+		return nil, ErrTooManyConnections
+	}
+
+	// Shutdown waits for the stream to be closed
+	lp.connections.Add(1)
+
+	connection, comunicationChannel, previousChannel := lp.openConnection(subscriptionID)
+	ready := lp.readyFrame
+	lp.mutex.Unlock()
+
+	lp.abortConnection(subscriptionID, previousChannel)
+
+	return &Stream{
+		lp:                  lp,
+		subscriptionID:      subscriptionID,
+		connection:          connection,
+		comunicationChannel: comunicationChannel,
+		resend:              true,
+		ready:               ready,
+	}, nil
+}
+
+// Ready returns the ReadyFrame that a transport must send before the events,
+// and false if SendReadyFrame is not enabled
+func (s *Stream) Ready() (ReadyFrame, bool) {
+	return ReadyFrame{"ready", s.subscriptionID}, s.ready
+}
+
+// SubscriptionID returns the subscription of the stream
+func (s *Stream) SubscriptionID() string {
+	return s.subscriptionID
+}
+
+// Next returns the queued events, or waits for the next ones. It returns
+// ErrSubscriptionRemoved if the client unsubscribed, ErrConnectionAborted if
+// a newer connection replaced the stream, ErrServiceUnavailable at the
+// shutdown, or the context error. In ack mode, the events not acknowledged
+// yet are returned again only by the first call.
+func (s *Stream) Next(ctx context.Context) ([]Event, error) {
+	lp := s.lp
+	for {
+		lp.mutex.Lock()
+		if err := s.check(); err != nil {
+			lp.mutex.Unlock()
+			return nil, err
+		}
+		events, _ := lp.fetchEvents(s.subscriptionID, s.resend, 0)
+		s.resend = false
+		if len(events) > 0 {
+			lp.mutex.Unlock()
+			return lp.transform(s.subscriptionID, events), nil
+		}
+		lp.globalClients[s.subscriptionID] = true
+		lp.mutex.Unlock()
+
+		select {
+		case operation := <-s.comunicationChannel:
+			switch operation {
+			case "DONE":
+				continue
+			case "UNSUBSCRIBE":
+				return nil, ErrSubscriptionRemoved
+			case "ABORT":
+				return nil, ErrConnectionAborted
+			default:
+				return nil, ErrServiceUnavailable
+			}
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// check verifies that the stream can still deliver events: the signals are
+// lost if they come while the stream is not waiting. It must be called
+// holding the lock.
+func (s *Stream) check() error {
+	lp := s.lp
+	if _, clientExists := lp.globalClients[s.subscriptionID]; clientExists == false {
+		return ErrSubscriptionRemoved
+	}
+	if current, ok := lp.globalClientToConnection[s.subscriptionID]; ok == false || current != s.connection {
+		return ErrConnectionAborted
+	}
+	if lp.shutdown == true {
+		return ErrServiceUnavailable
+	}
+	return nil
+}
+
+// Close releases the stream
+func (s *Stream) Close() {
+	s.lp.mutex.Lock()
+	s.lp.closeConnection(s.subscriptionID, s.connection)
+	s.lp.mutex.Unlock()
+	s.lp.connections.Done()
+}
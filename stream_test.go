@@ -0,0 +1,38 @@
+package longpoll
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestReadyFrame(t *testing.T) {
+	lp := New()
+	lp.SetLogger(nil)
+	lp.AddFeed("feed1")
+	lp.SendReadyFrame(true)
+	subscriptionID := subscribe(t, lp, "feed=feed1")
+
+	for name, test := range map[string]struct {
+		handler http.HandlerFunc
+		frame   []string
+	}{
+		"SSE":    {lp.SSEHandler, []string{"event: ready", `data: {"type":"ready","subscriptionId":"` + subscriptionID + `"}`}},
+		"NDJSON": {lp.StreamHandler, []string{`{"type":"ready","subscriptionId":"` + subscriptionID + `"}`}},
+	} {
+		server := httptest.NewServer(test.handler)
+		response, err := http.Get(server.URL + "?subscriptionID=" + subscriptionID)
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		scanner := bufio.NewScanner(response.Body)
+		for _, expected := range test.frame {
+			if scanner.Scan() == false || scanner.Text() != expected {
+				t.Fatalf("%s: expected %s, got %s", name, expected, scanner.Text())
+			}
+		}
+		response.Body.Close()
+		server.Close()
+	}
+}
@@ -0,0 +1,33 @@
+package longpoll
+
+import "net/http"
+
+// SubscribeAndListenResponse is the response of SubscribeAndListenHandler:
+// the new subscription, and the events received by its first listen request
+type SubscribeAndListenResponse struct {
+	SubscriptionID string `json:"subscriptionId"`
+	EventResponse
+}
+
+// SubscribeAndListenHandler subscribes the client, as SubscribeHandler, and
+// immediately waits for the events, as ListenHandler, so a client does not
+// need to store its subscriptionID between the requests. The subscription is
+// registered before waiting, so the events published in the meantime are
+// not lost. The subscriptionID is also sent in the X-Subscription-ID header,
+// so it is available even if the listen part fails (for example with a
+// timeout): the client can pass it to the following requests.
+func (lp *LongPoll) SubscribeAndListenHandler(w http.ResponseWriter, r *http.Request) {
+	r = withBody(r)
+	subscriptionID, _, ok := lp.subscribe(w, r)
+	if ok == false {
+		return
+	}
+	lp.mutex.RLock()
+	subscriptionIDHeader := lp.subscriptionIDHeader
+	lp.mutex.RUnlock()
+	w.Header().Set(subscriptionIDHeader, subscriptionID)
+
+	lp.listen(w, r, subscriptionID, func(eventResponse EventResponse) interface{} {
+		return SubscribeAndListenResponse{subscriptionID, eventResponse}
+	})
+}
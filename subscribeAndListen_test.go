@@ -0,0 +1,41 @@
+package longpoll
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+)
+
+func TestSubscribeAndListen(t *testing.T) {
+	lp := New()
+	lp.AddFeed("feed1")
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		w := httptest.NewRecorder()
+		lp.SubscribeAndListenHandler(w, httptest.NewRequest("GET", "/subscribeAndListen?feed=feed1", nil))
+		done <- w
+	}()
+	for subscribed := false; subscribed == false; runtime.Gosched() {
+		lp.mutex.RLock()
+		subscribed = len(lp.globalClients) > 0
+		lp.mutex.RUnlock()
+	}
+	lp.NewEvent("feed1", "published during the wait")
+
+	w := <-done
+	var response SubscribeAndListenResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("%s: %s", err, w.Body.String())
+	}
+	if response.SubscriptionID == "" || w.Header().Get(SubscriptionIDHeader) != response.SubscriptionID {
+		t.Fatalf("subscriptionID not returned: %s", w.Body.String())
+	}
+	if len(response.Events) != 1 || response.Events[0].Data != "published during the wait" {
+		t.Fatalf("event lost: %s", w.Body.String())
+	}
+	if _, exists := lp.GetSubscription(response.SubscriptionID); exists == false {
+		t.Fatal("subscription not registered")
+	}
+}
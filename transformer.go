@@ -0,0 +1,35 @@
+package longpoll
+
+// Transformer changes an event before it is delivered to a subscriber, for
+// example to hide the fields that the subscriber should not see. It is called
+// for every subscriber, so the same event can be tailored for each of them.
+// It must not change the ID of the event, and it must not modify the original
+// data (that is shared with the other subscribers): it should return a copy.
+type Transformer func(subscriptionID string, event Event) Event
+
+// SetTransformer sets the Transformer applied to the events delivered by the
+// listen requests, by the streams and to the in-process subscribers. A nil
+// Transformer (the default) delivers the events as they were published.
+func (lp *LongPoll) SetTransformer(transformer Transformer) {
+	lp.mutex.Lock()
+	lp.transformer = transformer
+	lp.mutex.Unlock()
+}
+
+// transform applies the Transformer, if any, to the events delivered to a
+// subscriber. It must be called without holding the lock, so the Transformer
+// can call the LongPoll methods.
+func (lp *LongPoll) transform(subscriptionID string, events []Event) []Event {
+	lp.mutex.RLock()
+	transformer := lp.transformer
+	lp.mutex.RUnlock()
+
+	if transformer == nil {
+		return events
+	}
+	transformed := make([]Event, 0, len(events))
+	for _, event := range events {
+		transformed = append(transformed, transformer(subscriptionID, event))
+	}
+	return transformed
+}
@@ -0,0 +1,30 @@
+package longpoll
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTransformer(t *testing.T) {
+	lp := New()
+	lp.AddFeed("feed1")
+	admin := subscribe(t, lp, "feed=feed1")
+	user := subscribe(t, lp, "feed=feed1")
+	lp.SetTransformer(func(subscriptionID string, event Event) Event {
+		if subscriptionID == user {
+			data := event.Data.(map[string]string)
+			event.Data = map[string]string{"name": data["name"]}
+		}
+		return event
+	})
+	lp.NewEvent("feed1", map[string]string{"name": "bob", "secret": "s3cr3t"})
+
+	body := listen(lp, "subscriptionID="+user).Body.String()
+	if strings.Contains(body, "s3cr3t") == true || strings.Contains(body, "bob") == false {
+		t.Fatalf("event not transformed for the user: %s", body)
+	}
+	body = listen(lp, "subscriptionID="+admin).Body.String()
+	if strings.Contains(body, "s3cr3t") == false {
+		t.Fatalf("event transformed for the admin: %s", body)
+	}
+}
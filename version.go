@@ -0,0 +1,5 @@
+package longpoll
+
+// Version is the version of the package. Until 1.0.0, the breaking changes
+// bump the minor version (see CHANGELOG.md).
+const Version = "0.3.0"
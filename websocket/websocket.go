@@ -0,0 +1,141 @@
+// Package websocket implements a WebSocket transport for the subscriptions of
+// a longpoll.LongPoll: after the upgrade, every event is sent as a JSON
+// message as soon as it is published, without the reconnections of the long
+// polling. It is a separate package, so the users that do not need it do not
+// depend on gorilla/websocket.
+//
+//	lp := longpoll.New()
+//	http.HandleFunc("/subscribe", lp.SubscribeHandler)
+//	http.Handle("/ws", websocket.NewHandler(lp))
+package websocket
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/frncscsrcc/longpoll"
+	gorilla "github.com/gorilla/websocket"
+)
+
+// Handler upgrades the requests of the subscribed clients to WebSocket
+// connections, and streams their events. It expects the same subscriptionID
+// used by the listen end-point.
+type Handler struct {
+	lp *longpoll.LongPoll
+	// Upgrader upgrades the HTTP connections. Set its CheckOrigin to accept
+	// the cross-origin requests.
+	Upgrader gorilla.Upgrader
+	// PingInterval is how often a ping is sent to the client: a client that
+	// does not answer for two intervals is disconnected
+	PingInterval time.Duration
+	// WriteTimeout is the maximum time to send a message
+	WriteTimeout time.Duration
+}
+
+// NewHandler is the constructor, it returns a pointer to a Handler that
+// streams the events of lp
+func NewHandler(lp *longpoll.LongPoll) *Handler {
+	return &Handler{
+		lp:           lp,
+		PingInterval: 30 * time.Second,
+		WriteTimeout: 10 * time.Second,
+	}
+}
+
+// ServeHTTP opens the stream of the subscription and upgrades the
+// connection. The errors before the upgrade are sent as in the other
+// handlers; after the upgrade, the connection is closed with a close message
+// that reports the reason (unsubscribe, new connection, shutdown...). With
+// longpoll's SendReadyFrame, the first message is the ReadyFrame.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	stream, err := h.lp.OpenStream(r)
+	if err != nil {
+		longpoll.WriteError(w, err)
+		return
+	}
+	defer stream.Close()
+
+	// Upgrade already responded in case of error
+	conn, err := h.Upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	go h.readLoop(conn, cancel)
+	go h.pingLoop(ctx, conn, cancel)
+
+	if ready, ok := stream.Ready(); ok == true {
+		conn.SetWriteDeadline(time.Now().Add(h.WriteTimeout))
+		if err := conn.WriteJSON(ready); err != nil {
+			return
+		}
+	}
+
+	for {
+		events, err := stream.Next(ctx)
+		if err != nil {
+			// The client went away, nobody reads the close message
+			if ctx.Err() == nil {
+				h.close(conn, err)
+			}
+			return
+		}
+		for _, event := range events {
+			conn.SetWriteDeadline(time.Now().Add(h.WriteTimeout))
+			if err := conn.WriteJSON(event); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// readLoop reads the messages of the client, to handle the pongs and the
+// close message, until the connection is closed or the client stops
+// answering the pings. The messages sent by the client are discarded.
+func (h *Handler) readLoop(conn *gorilla.Conn, cancel context.CancelFunc) {
+	defer cancel()
+
+	conn.SetReadDeadline(time.Now().Add(2 * h.PingInterval))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(2 * h.PingInterval))
+	})
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			return
+		}
+	}
+}
+
+// pingLoop sends a ping every PingInterval, until the context is done
+func (h *Handler) pingLoop(ctx context.Context, conn *gorilla.Conn, cancel context.CancelFunc) {
+	ticker := time.NewTicker(h.PingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := conn.WriteControl(gorilla.PingMessage, nil, time.Now().Add(h.WriteTimeout)); err != nil {
+				cancel()
+				return
+			}
+		}
+	}
+}
+
+// close sends the close message for the error that terminated the stream
+func (h *Handler) close(conn *gorilla.Conn, err error) {
+	code := gorilla.CloseNormalClosure
+	if errors.Is(err, longpoll.ErrServiceUnavailable) {
+		code = gorilla.CloseGoingAway
+	}
+	message := gorilla.FormatCloseMessage(code, err.Error())
+	conn.WriteControl(gorilla.CloseMessage, message, time.Now().Add(h.WriteTimeout))
+}